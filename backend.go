@@ -0,0 +1,160 @@
+package flashback
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ExecutorBackend executes each type of op through a particular driver. It is
+// what keeps OpsExecutor, and the stats, independent from the driver. A
+// backend is used by a single worker at a time.
+//
+// The ops give up once their context is done, i.e. past the executor's
+// deadline, so that the next op of the worker doesn't run next to them.
+type ExecutorBackend interface {
+	Query(ctx context.Context, op *Op) ([]Document, error)
+	Insert(ctx context.Context, op *Op) error
+	Update(ctx context.Context, op *Op) (*WriteOutcome, error)
+	Remove(ctx context.Context, op *Op) (*WriteOutcome, error)
+	Count(ctx context.Context, op *Op) (int, error)
+	// FindAndModify returns the document before it was modified
+	FindAndModify(ctx context.Context, op *Op) (Document, error)
+
+	// Explain returns what explain says about the way the node runs an op
+	Explain(op *Op) (Document, error)
+	// DBHash returns the hash of each of the collections of a database.
+	// Collections that don't exist are left out.
+	DBHash(database string, collections []string) (map[string]string, error)
+	// ScanCollection calls fn with every document of a collection, in _id
+	// order, until fn returns false. The documents keep the order of their
+	// fields, which dbHash is sensitive to.
+	ScanCollection(database, collection string, fn func(doc bson.D) bool) error
+
+	// Classify tells why an op failed with err, which decides whether it is
+	// worth running again, see RetryPolicy. The code is the one of the server
+	// error, 0 if the error doesn't come from the server.
+	Classify(err error) (category ErrorCategory, code int)
+	// Refresh recovers from connection errors
+	Refresh()
+	Close()
+}
+
+// WriteOutcome is what a write did on a node, so that it can be compared
+// across nodes
+type WriteOutcome struct {
+	Matched  int
+	Modified int
+	Removed  int
+	// Whether an upsert inserted a document
+	Upserted bool
+	// The _id of the document an upsert inserted, when the op named it. The
+	// _ids that the server generates differ from node to node, and are left
+	// out, see upsertNamesId.
+	UpsertedId interface{}
+}
+
+func (o *WriteOutcome) String() string {
+	upserted := "none"
+	if o.UpsertedId != nil {
+		upserted = docString(o.UpsertedId)
+	} else if o.Upserted {
+		upserted = "generated _id"
+	}
+	return fmt.Sprintf("{matched: %d, modified: %d, removed: %d, upserted: %s}",
+		o.Matched, o.Modified, o.Removed, upserted)
+}
+
+// BackendPool connects to a node, and hands out backends that share its
+// connections
+type BackendPool interface {
+	Get() ExecutorBackend
+	Close()
+}
+
+// The available drivers
+const (
+	MgoDriver     = "mgo"
+	MongoGoDriver = "mongo-driver"
+)
+
+// DialBackend connects to a node with the driver it asks for
+func DialBackend(node NodeConfig) (BackendPool, error) {
+	switch node.Driver {
+	case "", MgoDriver:
+		return dialMgo(node)
+	case MongoGoDriver:
+		return dialMongoDriver(node)
+	}
+	return nil, fmt.Errorf("unknown driver %q, the only acceptable values are %q and %q",
+		node.Driver, MgoDriver, MongoGoDriver)
+}
+
+// invalidOpError is the error of the ops that can't be run as they were
+// recorded
+type invalidOpError string
+
+func (e invalidOpError) Error() string {
+	return string(e)
+}
+
+// countQuery extracts the query of a count command, which counts the whole
+// collection when it has none
+func countQuery(op *Op) (bson.D, error) {
+	value, ok := GetElem(op.CommandDoc, "query")
+	if !ok || value == nil {
+		return nil, nil
+	}
+	query, ok := value.(bson.D)
+	if !ok {
+		return nil, invalidOpError("bad query document in count operation")
+	}
+	return query, nil
+}
+
+// findAndModifyArgs extracts the query and update documents of a
+// findAndModify command
+func findAndModifyArgs(op *Op) (query bson.D, update bson.D, err error) {
+	// Maybe clean this up later using a struct
+	if value, ok := GetElem(op.CommandDoc, "query"); ok {
+		if query, ok = value.(bson.D); !ok {
+			return nil, nil, invalidOpError("bad query document in findAndModify operation")
+		}
+	} else {
+		return nil, nil, invalidOpError("missing query document in findAndModify operation")
+	}
+	if value, ok := GetElem(op.CommandDoc, "update"); ok {
+		if update, ok = value.(bson.D); !ok {
+			return nil, nil, invalidOpError("bad update document in findAndModify operation")
+		}
+	} else {
+		return nil, nil, invalidOpError("missing update document in findAndModify operation")
+	}
+	return query, update, nil
+}
+
+// upsertNamesId tells whether the document an upsert inserts takes its _id
+// from the op, i.e. from an equality on _id in its query, or from its update,
+// rather than from the server
+func upsertNamesId(op *Op) bool {
+	if id, ok := GetElem(op.QueryDoc, "_id"); ok {
+		if doc, ok := id.(bson.D); !ok || len(doc) == 0 || !strings.HasPrefix(doc[0].Name, "$") {
+			return true
+		}
+	}
+	if _, ok := GetElem(op.UpdateDoc, "_id"); ok {
+		return true
+	}
+	for _, operator := range []string{"$set", "$setOnInsert"} {
+		if fields, ok := GetElem(op.UpdateDoc, operator); ok {
+			if fields, ok := fields.(bson.D); ok {
+				if _, ok := GetElem(fields, "_id"); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
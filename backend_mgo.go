@@ -0,0 +1,433 @@
+package flashback
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type mgoPool struct {
+	session *mgo.Session
+}
+
+func dialMgo(node NodeConfig) (BackendPool, error) {
+	dialInfo, err := mgo.ParseURL(node.Url)
+	if err != nil {
+		return nil, err
+	}
+	if node.Username != "" {
+		dialInfo.Username = node.Username
+		dialInfo.Password = node.Password
+	}
+	if node.AuthSource != "" {
+		dialInfo.Source = node.AuthSource
+	}
+	if node.AuthMechanism != "" {
+		dialInfo.Mechanism = node.AuthMechanism
+	}
+	if node.Direct {
+		dialInfo.Direct = true
+	}
+	if node.ConnectTimeout > 0 {
+		dialInfo.Timeout = node.ConnectTimeout
+	}
+	session, err := mgo.DialWithInfo(dialInfo)
+	if err != nil {
+		return nil, err
+	}
+	session.SetSocketTimeout(node.SocketTimeout)
+	if node.PoolLimit > 0 {
+		session.SetPoolLimit(node.PoolLimit)
+	}
+	return &mgoPool{session}, nil
+}
+
+// Get hands out a copy of the session, so that each worker has its own socket
+func (p *mgoPool) Get() ExecutorBackend {
+	return NewMgoBackend(p.session.Copy())
+}
+
+func (p *mgoPool) Close() {
+	p.session.Close()
+}
+
+// MgoBackend runs the ops through an mgo session
+type MgoBackend struct {
+	session *mgo.Session
+
+	// the sessions of the routed ops, copied from session on first use
+	mutex  sync.Mutex
+	routes map[mgoRoute]*mgo.Session
+}
+
+type mgoRoute struct {
+	mode         ReadMode
+	session      string
+	writeConcern WriteConcern
+}
+
+var mgoModes = map[ReadMode]mgo.Mode{
+	PrimaryMode:            mgo.Primary,
+	PrimaryPreferredMode:   mgo.PrimaryPreferred,
+	SecondaryMode:          mgo.Secondary,
+	SecondaryPreferredMode: mgo.SecondaryPreferred,
+	NearestMode:            mgo.Nearest,
+}
+
+func NewMgoBackend(session *mgo.Session) *MgoBackend {
+	return &MgoBackend{session: session, routes: make(map[mgoRoute]*mgo.Session)}
+}
+
+// sessionOf is the session op is routed to, see RouteRule, with its write
+// concern
+func (b *MgoBackend) sessionOf(op *Op) *mgo.Session {
+	route := mgoRoute{op.ReadMode, op.Session, op.WriteConcern}
+	if route == (mgoRoute{}) {
+		return b.session
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	session, ok := b.routes[route]
+	if !ok {
+		session = b.session.Copy()
+		if mode, ok := mgoModes[op.ReadMode]; ok {
+			session.SetMode(mode, true)
+		}
+		if !op.WriteConcern.isDefault() {
+			session.SetSafe(mgoSafe(op.WriteConcern))
+		}
+		b.routes[route] = session
+	}
+	return session
+}
+
+// mgoSafe is the mgo version of a write concern, nil for unacknowledged
+// writes
+func mgoSafe(c WriteConcern) *mgo.Safe {
+	safe := &mgo.Safe{J: c.J, WTimeout: int(c.WTimeout / time.Millisecond)}
+	if n, ok := c.wNumber(); ok {
+		if n == 0 {
+			return nil
+		}
+		safe.W = n
+	} else {
+		safe.WMode = c.W
+	}
+	return safe
+}
+
+// run runs fn on the session of op until ctx is done. mgo can't cancel an
+// op, so an op that still runs by then is left its session, which is closed
+// once the op is over, and the next ops run on a fresh copy of it, on another
+// socket.
+func (b *MgoBackend) run(ctx context.Context, op *Op,
+	fn func(session *mgo.Session) (interface{}, error)) (interface{}, error) {
+
+	session := b.sessionOf(op)
+	if ctx.Done() == nil {
+		return fn(session)
+	}
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := fn(session)
+		done <- outcome{result, err}
+	}()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		b.replaceSession(op, session)
+		go func() {
+			<-done
+			session.Close()
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// replaceSession swaps session, the one op ran on, for a fresh copy of it
+func (b *MgoBackend) replaceSession(op *Op, session *mgo.Session) {
+	fresh := session.Copy()
+	if session == b.session {
+		b.session = fresh
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.routes[mgoRoute{op.ReadMode, op.Session, op.WriteConcern}] = fresh
+}
+
+func mgoCollection(session *mgo.Session, op *Op) *mgo.Collection {
+	return session.DB(op.Database).C(op.Collection)
+}
+
+func (b *MgoBackend) Query(ctx context.Context, op *Op) ([]Document, error) {
+	result, err := b.run(ctx, op, func(session *mgo.Session) (interface{}, error) {
+		query := mgoCollection(session, op).Find(op.QueryDoc)
+		if op.NToSkip != 0 {
+			query.Skip(int(op.NToSkip))
+		}
+		if op.NToReturn != 0 {
+			query.Limit(int(op.NToReturn))
+		}
+		if op.MaxTime > 0 {
+			query.SetMaxTime(op.MaxTime)
+		}
+		result := []Document{}
+		err := query.All(&result)
+		return result, err
+	})
+	docs, _ := result.([]Document)
+	return docs, err
+}
+
+func (b *MgoBackend) Insert(ctx context.Context, op *Op) error {
+	_, err := b.run(ctx, op, func(session *mgo.Session) (interface{}, error) {
+		return nil, mgoCollection(session, op).Insert(op.InsertDoc)
+	})
+	return err
+}
+
+// Update runs as a bulk of one, since Collection.Update drops the number of
+// documents matched and modified. Like Collection.Update, it fails with
+// mgo.ErrNotFound when no document matches. Upserts run through
+// Collection.Upsert instead, since bulks drop the upserted _id.
+func (b *MgoBackend) Update(ctx context.Context, op *Op) (*WriteOutcome, error) {
+	result, err := b.run(ctx, op, func(session *mgo.Session) (interface{}, error) {
+		if op.Upsert {
+			return mgoUpsert(session, op)
+		}
+		bulk := mgoCollection(session, op).Bulk()
+		bulk.Update(op.QueryDoc, op.UpdateDoc)
+		result, err := bulk.Run()
+		if err != nil {
+			return nil, unwrapBulkError(err)
+		}
+		outcome := &WriteOutcome{Matched: result.Matched, Modified: result.Modified}
+		// nothing is known about unacknowledged writes
+		if outcome.Matched == 0 && !op.WriteConcern.unacknowledged() {
+			return outcome, mgo.ErrNotFound
+		}
+		return outcome, nil
+	})
+	outcome, _ := result.(*WriteOutcome)
+	return outcome, err
+}
+
+func mgoUpsert(session *mgo.Session, op *Op) (*WriteOutcome, error) {
+	info, err := mgoCollection(session, op).Upsert(op.QueryDoc, op.UpdateDoc)
+	if err != nil {
+		return nil, err
+	}
+	// nothing is known about unacknowledged writes
+	if info == nil {
+		return &WriteOutcome{}, nil
+	}
+	outcome := &WriteOutcome{Matched: info.Matched, Modified: info.Updated, Upserted: info.Matched == 0}
+	if outcome.Upserted && upsertNamesId(op) {
+		outcome.UpsertedId = info.UpsertedId
+	}
+	return outcome, nil
+}
+
+// Remove runs as a bulk of one, for the same reasons as Update
+func (b *MgoBackend) Remove(ctx context.Context, op *Op) (*WriteOutcome, error) {
+	result, err := b.run(ctx, op, func(session *mgo.Session) (interface{}, error) {
+		bulk := mgoCollection(session, op).Bulk()
+		bulk.Remove(op.QueryDoc)
+		result, err := bulk.Run()
+		if err != nil {
+			return nil, unwrapBulkError(err)
+		}
+		outcome := &WriteOutcome{Matched: result.Matched, Removed: result.Matched}
+		if outcome.Matched == 0 && !op.WriteConcern.unacknowledged() {
+			return outcome, mgo.ErrNotFound
+		}
+		return outcome, nil
+	})
+	outcome, _ := result.(*WriteOutcome)
+	return outcome, err
+}
+
+// unwrapBulkError returns the error of a bulk of one as Collection.Update and
+// Collection.Remove would, so that Classify can tell it apart
+func unwrapBulkError(err error) error {
+	if bulkErr, ok := err.(*mgo.BulkError); ok {
+		if cases := bulkErr.Cases(); len(cases) == 1 {
+			return cases[0].Err
+		}
+	}
+	return err
+}
+
+// Count runs the count command itself when it has a maxTimeMS, which mgo
+// doesn't pass on
+func (b *MgoBackend) Count(ctx context.Context, op *Op) (int, error) {
+	query, err := countQuery(op)
+	if err != nil {
+		return 0, err
+	}
+	result, err := b.run(ctx, op, func(session *mgo.Session) (interface{}, error) {
+		if op.MaxTime == 0 {
+			return mgoCollection(session, op).Find(query).Count()
+		}
+		result := struct{ N int }{}
+		cmd := bson.D{{"count", op.Collection}}
+		if query != nil {
+			cmd = append(cmd, bson.DocElem{"query", query})
+		}
+		cmd = append(cmd, bson.DocElem{"maxTimeMS", maxTimeMS(op.MaxTime)})
+		err := session.DB(op.Database).Run(cmd, &result)
+		return result.N, err
+	})
+	count, _ := result.(int)
+	return count, err
+}
+
+func (b *MgoBackend) FindAndModify(ctx context.Context, op *Op) (Document, error) {
+	query, update, err := findAndModifyArgs(op)
+	if err != nil {
+		return nil, err
+	}
+	result, err := b.run(ctx, op, func(session *mgo.Session) (interface{}, error) {
+		if op.MaxTime > 0 || !op.WriteConcern.isDefault() {
+			return mgoFindAndModifyCommand(session, op, query, update)
+		}
+		result := Document{}
+		change := mgo.Change{Update: update}
+		_, err := mgoCollection(session, op).Find(query).Apply(change, result)
+		return result, err
+	})
+	doc, _ := result.(Document)
+	return doc, err
+}
+
+// mgoFindAndModifyCommand runs the findAndModify command like Query.Apply
+// does, with the maxTimeMS and the writeConcern that Query.Apply doesn't pass
+// on
+func mgoFindAndModifyCommand(session *mgo.Session, op *Op, query, update bson.D) (Document, error) {
+	result := struct {
+		Value     Document `bson:"value"`
+		LastError struct {
+			N int `bson:"n"`
+		} `bson:"lastErrorObject"`
+	}{}
+	cmd := bson.D{{"findAndModify", op.Collection}, {"query", query}, {"update", update}}
+	if op.MaxTime > 0 {
+		cmd = append(cmd, bson.DocElem{"maxTimeMS", maxTimeMS(op.MaxTime)})
+	}
+	if !op.WriteConcern.isDefault() {
+		cmd = append(cmd, bson.DocElem{"writeConcern", op.WriteConcern.document()})
+	}
+	err := session.DB(op.Database).Run(cmd, &result)
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Message == "No matching object found" {
+		return nil, mgo.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.LastError.N == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	return result.Value, nil
+}
+
+func maxTimeMS(maxTime time.Duration) int64 {
+	return int64(maxTime / time.Millisecond)
+}
+
+func (b *MgoBackend) Explain(op *Op) (Document, error) {
+	cmd, err := explainCommand(op)
+	if err != nil {
+		return nil, err
+	}
+	result := Document{}
+	err = b.session.DB(op.Database).Run(cmd, &result)
+	return result, err
+}
+
+func (b *MgoBackend) DBHash(database string, collections []string) (map[string]string, error) {
+	result := struct {
+		Collections map[string]string `bson:"collections"`
+	}{}
+	cmd := bson.D{{"dbHash", 1}, {"collections", collections}}
+	err := b.session.DB(database).Run(cmd, &result)
+	return result.Collections, err
+}
+
+func (b *MgoBackend) ScanCollection(database, collection string, fn func(doc bson.D) bool) error {
+	iter := b.session.DB(database).C(collection).Find(nil).Sort("_id").Iter()
+	var doc bson.D
+	for iter.Next(&doc) {
+		if !fn(doc) {
+			break
+		}
+		doc = nil
+	}
+	return iter.Close()
+}
+
+// The plain errors mgo reports connection problems with, i.e. during a
+// failover
+var mgoNetworkErrors = map[string]struct{}{
+	"no reachable servers": {},
+	"Closed explicitly":    {},
+	"server was closed":    {},
+	"server not available": {},
+}
+
+// Classify tells server errors apart by their code. Of the plain errors, only
+// the closed sockets and the connection problems mgo reports as such are
+// network errors, the others, i.e. documents that can't be marshalled, are
+// other errors.
+func (b *MgoBackend) Classify(err error) (ErrorCategory, int) {
+	switch err := err.(type) {
+	case *mgo.QueryError:
+		return categoryOfServerError(err.Code, err.Message), err.Code
+	case *mgo.LastError:
+		return categoryOfServerError(err.Code, err.Err), err.Code
+	case invalidOpError:
+		return OtherError, 0
+	case net.Error:
+		if err.Timeout() {
+			return TimeoutError, 0
+		}
+		return NetworkError, 0
+	}
+
+	// mgo reports closed sockets as they come
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return NetworkError, 0
+	}
+	if _, ok := mgoNetworkErrors[err.Error()]; ok {
+		return NetworkError, 0
+	}
+	return OtherError, 0
+}
+
+func (b *MgoBackend) Refresh() {
+	b.session.Refresh()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, session := range b.routes {
+		session.Refresh()
+	}
+}
+
+func (b *MgoBackend) Close() {
+	b.session.Close()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, session := range b.routes {
+		session.Close()
+	}
+}
@@ -0,0 +1,443 @@
+package flashback
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"gopkg.in/mgo.v2"
+	mgobson "gopkg.in/mgo.v2/bson"
+)
+
+type mongoDriverPool struct {
+	client *mongo.Client
+}
+
+func dialMongoDriver(node NodeConfig) (BackendPool, error) {
+	// be as lenient as mgo about the urls
+	url := node.Url
+	if url == "" {
+		url = "mongodb://localhost:27017"
+	} else if !strings.Contains(url, "://") {
+		url = "mongodb://" + url
+	}
+
+	opts := options.Client().ApplyURI(url).SetSocketTimeout(node.SocketTimeout)
+	if node.Username != "" || node.AuthMechanism != "" {
+		opts.SetAuth(options.Credential{
+			Username:      node.Username,
+			Password:      node.Password,
+			AuthSource:    node.AuthSource,
+			AuthMechanism: node.AuthMechanism,
+		})
+	}
+	if node.Direct {
+		opts.SetDirect(true)
+	}
+	if node.PoolLimit > 0 {
+		opts.SetMaxPoolSize(uint64(node.PoolLimit))
+	}
+	if node.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(node.ConnectTimeout)
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Connect doesn't wait for the server, check it's reachable like mgo does
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return &mongoDriverPool{client}, nil
+}
+
+// Get hands out a backend on the shared client, which pools the connections
+// on its own
+func (p *mongoDriverPool) Get() ExecutorBackend {
+	return NewMongoDriverBackend(p.client)
+}
+
+func (p *mongoDriverPool) Close() {
+	p.client.Disconnect(context.Background())
+}
+
+// MongoDriverBackend runs the ops through the official MongoDB Go driver,
+// which speaks OP_MSG and supports sessions, transactions and newer auth
+// mechanisms
+type MongoDriverBackend struct {
+	client *mongo.Client
+}
+
+func NewMongoDriverBackend(client *mongo.Client) *MongoDriverBackend {
+	return &MongoDriverBackend{client}
+}
+
+var readPrefs = map[ReadMode]*readpref.ReadPref{
+	PrimaryMode:            readpref.Primary(),
+	PrimaryPreferredMode:   readpref.PrimaryPreferred(),
+	SecondaryMode:          readpref.Secondary(),
+	SecondaryPreferredMode: readpref.SecondaryPreferred(),
+	NearestMode:            readpref.Nearest(),
+}
+
+// collection routes the reads with the read preference of op, see RouteRule,
+// and sets its write or read concern
+func (b *MongoDriverBackend) collection(op *Op) *mongo.Collection {
+	opts := options.Collection()
+	if pref, ok := readPrefs[op.ReadMode]; ok {
+		opts.SetReadPreference(pref)
+	}
+	if !op.WriteConcern.isDefault() {
+		opts.SetWriteConcern(mongoWriteConcern(op.WriteConcern))
+	}
+	if op.ReadConcern != "" {
+		opts.SetReadConcern(&readconcern.ReadConcern{Level: op.ReadConcern})
+	}
+	return b.client.Database(op.Database).Collection(op.Collection, opts)
+}
+
+func mongoWriteConcern(c WriteConcern) *writeconcern.WriteConcern {
+	writeConcern := &writeconcern.WriteConcern{W: c.W, WTimeout: c.WTimeout}
+	if n, ok := c.wNumber(); ok {
+		writeConcern.W = n
+	}
+	if c.J {
+		journal := true
+		writeConcern.Journal = &journal
+	}
+	return writeConcern
+}
+
+// toRaw converts the mgo documents of the recorded ops to something the
+// driver understands
+func toRaw(doc interface{}) (bson.Raw, error) {
+	if doc == nil {
+		doc = mgobson.D{}
+	}
+	data, err := mgobson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(data), nil
+}
+
+// fromDriverValue converts a value that the driver decoded to the type mgo
+// decodes it to, i.e. a primitive.ObjectID to a bson.ObjectId, so that it
+// compares equal across drivers
+func fromDriverValue(value interface{}) (interface{}, error) {
+	data, err := bson.Marshal(bson.D{{Key: "v", Value: value}})
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		V interface{} `bson:"v"`
+	}
+	return doc.V, mgobson.Unmarshal(data, &doc)
+}
+
+// isReplacement tells whether an update document replaces the whole document,
+// rather than using update operators
+func isReplacement(update mgobson.D) bool {
+	return len(update) == 0 || !strings.HasPrefix(update[0].Name, "$")
+}
+
+func (b *MongoDriverBackend) Query(ctx context.Context, op *Op) ([]Document, error) {
+	// Legacy queries wrap the filter in $query, next to modifiers such as
+	// $orderby
+	filter := op.QueryDoc
+	opts := options.Find()
+	if query, ok := GetElem(op.QueryDoc, "$query"); ok {
+		filter, _ = query.(mgobson.D)
+		for _, elem := range op.QueryDoc {
+			var err error
+			switch elem.Name {
+			case "$orderby":
+				var sort bson.Raw
+				if sort, err = toRaw(elem.Value); err == nil {
+					opts.SetSort(sort)
+				}
+			case "$hint":
+				var hint bson.Raw
+				if hint, err = toRaw(elem.Value); err == nil {
+					opts.SetHint(hint)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if op.NToSkip != 0 {
+		opts.SetSkip(int64(op.NToSkip))
+	}
+	if op.NToReturn != 0 {
+		opts.SetLimit(int64(op.NToReturn))
+	}
+	if op.MaxTime > 0 {
+		opts.SetMaxTime(op.MaxTime)
+	}
+
+	rawFilter, err := toRaw(filter)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := b.collection(op).Find(ctx, rawFilter, opts)
+	if err != nil {
+		return nil, err
+	}
+	// the cursor is killed on the server even once ctx is done
+	defer cursor.Close(context.Background())
+
+	result := []Document{}
+	for cursor.Next(ctx) {
+		doc := Document{}
+		if err := mgobson.Unmarshal(cursor.Current, &doc); err != nil {
+			return result, err
+		}
+		result = append(result, doc)
+	}
+	return result, cursor.Err()
+}
+
+func (b *MongoDriverBackend) Insert(ctx context.Context, op *Op) error {
+	doc, err := toRaw(op.InsertDoc)
+	if err != nil {
+		return err
+	}
+	_, err = b.collection(op).InsertOne(ctx, doc)
+	if errors.Is(err, mongo.ErrUnacknowledgedWrite) {
+		return nil
+	}
+	return err
+}
+
+// Update fails with mgo.ErrNotFound when no document matches, like the mgo
+// backend, so that both drivers report the same errors
+func (b *MongoDriverBackend) Update(ctx context.Context, op *Op) (*WriteOutcome, error) {
+	filter, err := toRaw(op.QueryDoc)
+	if err != nil {
+		return nil, err
+	}
+	update, err := toRaw(op.UpdateDoc)
+	if err != nil {
+		return nil, err
+	}
+	var result *mongo.UpdateResult
+	if isReplacement(op.UpdateDoc) {
+		opts := options.Replace().SetUpsert(op.Upsert)
+		result, err = b.collection(op).ReplaceOne(ctx, filter, update, opts)
+	} else {
+		opts := options.Update().SetUpsert(op.Upsert)
+		result, err = b.collection(op).UpdateOne(ctx, filter, update, opts)
+	}
+	// nothing is known about unacknowledged writes
+	if errors.Is(err, mongo.ErrUnacknowledgedWrite) {
+		return &WriteOutcome{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	outcome := &WriteOutcome{
+		Matched:  int(result.MatchedCount),
+		Modified: int(result.ModifiedCount),
+		Upserted: result.UpsertedCount > 0,
+	}
+	if outcome.Upserted && upsertNamesId(op) {
+		if outcome.UpsertedId, err = fromDriverValue(result.UpsertedID); err != nil {
+			return nil, err
+		}
+	}
+	if outcome.Matched == 0 && !outcome.Upserted {
+		return outcome, mgo.ErrNotFound
+	}
+	return outcome, nil
+}
+
+// Remove fails with mgo.ErrNotFound when no document matches, like Update
+func (b *MongoDriverBackend) Remove(ctx context.Context, op *Op) (*WriteOutcome, error) {
+	filter, err := toRaw(op.QueryDoc)
+	if err != nil {
+		return nil, err
+	}
+	result, err := b.collection(op).DeleteOne(ctx, filter)
+	if errors.Is(err, mongo.ErrUnacknowledgedWrite) {
+		return &WriteOutcome{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	removed := int(result.DeletedCount)
+	outcome := &WriteOutcome{Matched: removed, Removed: removed}
+	if removed == 0 {
+		return outcome, mgo.ErrNotFound
+	}
+	return outcome, nil
+}
+
+// Count reads the collection metadata when the count has no query, like the
+// count command does
+func (b *MongoDriverBackend) Count(ctx context.Context, op *Op) (int, error) {
+	query, err := countQuery(op)
+	if err != nil {
+		return 0, err
+	}
+	if query == nil {
+		opts := options.EstimatedDocumentCount()
+		if op.MaxTime > 0 {
+			opts.SetMaxTime(op.MaxTime)
+		}
+		count, err := b.collection(op).EstimatedDocumentCount(ctx, opts)
+		return int(count), err
+	}
+	filter, err := toRaw(query)
+	if err != nil {
+		return 0, err
+	}
+	opts := options.Count()
+	if op.MaxTime > 0 {
+		opts.SetMaxTime(op.MaxTime)
+	}
+	count, err := b.collection(op).CountDocuments(ctx, filter, opts)
+	return int(count), err
+}
+
+func (b *MongoDriverBackend) FindAndModify(ctx context.Context, op *Op) (Document, error) {
+	query, update, err := findAndModifyArgs(op)
+	if err != nil {
+		return nil, err
+	}
+	rawQuery, err := toRaw(query)
+	if err != nil {
+		return nil, err
+	}
+	rawUpdate, err := toRaw(update)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *mongo.SingleResult
+	if isReplacement(update) {
+		opts := options.FindOneAndReplace()
+		if op.MaxTime > 0 {
+			opts.SetMaxTime(op.MaxTime)
+		}
+		result = b.collection(op).FindOneAndReplace(ctx, rawQuery, rawUpdate, opts)
+	} else {
+		opts := options.FindOneAndUpdate()
+		if op.MaxTime > 0 {
+			opts.SetMaxTime(op.MaxTime)
+		}
+		result = b.collection(op).FindOneAndUpdate(ctx, rawQuery, rawUpdate, opts)
+	}
+	raw, err := result.Raw()
+	if errors.Is(err, mongo.ErrUnacknowledgedWrite) {
+		return Document{}, nil
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, mgo.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc := Document{}
+	return doc, mgobson.Unmarshal(raw, &doc)
+}
+
+func (b *MongoDriverBackend) Explain(op *Op) (Document, error) {
+	explain, err := explainCommand(op)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := toRaw(explain)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := b.client.Database(op.Database).RunCommand(context.Background(), cmd).Raw()
+	if err != nil {
+		return nil, err
+	}
+	result := Document{}
+	return result, mgobson.Unmarshal(raw, &result)
+}
+
+func (b *MongoDriverBackend) DBHash(database string, collections []string) (map[string]string, error) {
+	cmd, err := toRaw(mgobson.D{{"dbHash", 1}, {"collections", collections}})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := b.client.Database(database).RunCommand(context.Background(), cmd).Raw()
+	if err != nil {
+		return nil, err
+	}
+	result := struct {
+		Collections map[string]string `bson:"collections"`
+	}{}
+	return result.Collections, mgobson.Unmarshal(raw, &result)
+}
+
+func (b *MongoDriverBackend) ScanCollection(database, collection string, fn func(doc mgobson.D) bool) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	ctx := context.Background()
+	cursor, err := b.client.Database(database).Collection(collection).Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc mgobson.D
+		if err := mgobson.Unmarshal(cursor.Current, &doc); err != nil {
+			return err
+		}
+		if !fn(doc) {
+			break
+		}
+	}
+	return cursor.Err()
+}
+
+// Classify counts maxTimeMS, socket and server selection timeouts as
+// timeouts
+func (b *MongoDriverBackend) Classify(err error) (ErrorCategory, int) {
+	code, message := 0, ""
+	var commandErr mongo.CommandError
+	var writeErr mongo.WriteException
+	if errors.As(err, &commandErr) {
+		code, message = int(commandErr.Code), commandErr.Message
+	} else if errors.As(err, &writeErr) {
+		if len(writeErr.WriteErrors) > 0 {
+			code, message = writeErr.WriteErrors[0].Code, writeErr.WriteErrors[0].Message
+		} else if writeErr.WriteConcernError != nil {
+			code, message = writeErr.WriteConcernError.Code, writeErr.WriteConcernError.Message
+		}
+	}
+
+	switch {
+	case mongo.IsTimeout(err):
+		return TimeoutError, code
+	case mongo.IsDuplicateKeyError(err):
+		return DuplicateKeyError, code
+	case mongo.IsNetworkError(err):
+		return NetworkError, code
+	case code != 0 || message != "":
+		return categoryOfServerError(code, message), code
+	}
+	return OtherError, 0
+}
+
+// Refresh does nothing, the driver replaces broken connections on its own
+func (b *MongoDriverBackend) Refresh() {
+}
+
+// Close does nothing, the client is shared with the other workers
+func (b *MongoDriverBackend) Close() {
+}
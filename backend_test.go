@@ -0,0 +1,149 @@
+package flashback
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDialUnknownBackend(t *testing.T) {
+	t.Parallel()
+
+	_, err := DialBackend(NodeConfig{Name: "default", Driver: "odbc"})
+	ensure.NotNil(t, err)
+}
+
+func TestCountQuery(t *testing.T) {
+	t.Parallel()
+
+	op := &Op{CommandDoc: bson.D{
+		{Name: "count", Value: "coll"},
+		{Name: "query", Value: bson.D{{Name: "a", Value: 1}}},
+	}}
+	query, err := countQuery(op)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, query, bson.D{{Name: "a", Value: 1}})
+
+	op.CommandDoc = op.CommandDoc[:1]
+	query, err = countQuery(op)
+	ensure.Nil(t, err)
+	ensure.True(t, query == nil)
+	op.CommandDoc = bson.D{{Name: "count", Value: "coll"}, {Name: "query", Value: "oops"}}
+	_, err = countQuery(op)
+	ensure.NotNil(t, err)
+}
+
+func TestFindAndModifyArgs(t *testing.T) {
+	t.Parallel()
+
+	op := &Op{CommandDoc: bson.D{
+		{Name: "findandmodify", Value: "coll"},
+		{Name: "query", Value: bson.D{{Name: "_id", Value: 1}}},
+		{Name: "update", Value: bson.D{{Name: "$inc", Value: bson.D{{Name: "n", Value: 1}}}}},
+	}}
+	query, update, err := findAndModifyArgs(op)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, query, bson.D{{Name: "_id", Value: 1}})
+	ensure.DeepEqual(t, update[0].Name, "$inc")
+
+	op.CommandDoc = op.CommandDoc[:2]
+	_, _, err = findAndModifyArgs(op)
+	ensure.NotNil(t, err)
+	op.CommandDoc = bson.D{{Name: "findandmodify", Value: "coll"}, {Name: "query", Value: "oops"}}
+	_, _, err = findAndModifyArgs(op)
+	ensure.NotNil(t, err)
+}
+
+// timeoutError is how the net package reports socket timeouts
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestMgoBackendClassify(t *testing.T) {
+	t.Parallel()
+
+	backend := NewMgoBackend(nil)
+	cases := []struct {
+		err      error
+		category ErrorCategory
+		code     int
+	}{
+		{&mgo.QueryError{Code: 50, Message: "operation exceeded time limit"}, TimeoutError, 50},
+		{&mgo.LastError{Code: 11000}, DuplicateKeyError, 11000},
+		{&mgo.QueryError{Code: 13}, AuthError, 13},
+		{&mgo.QueryError{Code: 10107}, NotPrimaryError, 10107},
+		{&mgo.LastError{Err: "not master"}, NotPrimaryError, 0},
+		{&mgo.QueryError{Code: 2}, ServerError, 2},
+		{timeoutError{}, TimeoutError, 0},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, NetworkError, 0},
+		{io.EOF, NetworkError, 0},
+		{errors.New("no reachable servers"), NetworkError, 0},
+		{errors.New("Closed explicitly"), NetworkError, 0},
+		{mgo.ErrNotFound, OtherError, 0},
+		{errors.New("cannot marshal"), OtherError, 0},
+		{NotSupported, OtherError, 0},
+		{invalidOpError("missing update"), OtherError, 0},
+	}
+	for _, c := range cases {
+		category, code := backend.Classify(c.err)
+		ensure.DeepEqual(t, category, c.category, c.err)
+		ensure.DeepEqual(t, code, c.code, c.err)
+	}
+}
+
+func TestMongoDriverConversions(t *testing.T) {
+	t.Parallel()
+
+	ensure.True(t, isReplacement(bson.D{{Name: "name", Value: "x"}}))
+	ensure.False(t, isReplacement(bson.D{{Name: "$set", Value: bson.D{{Name: "name", Value: "x"}}}}))
+
+	raw, err := toRaw(bson.D{{Name: "a", Value: 1}, {Name: "b", Value: "two"}})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, raw.Lookup("b").StringValue(), "two")
+
+	// missing documents are empty ones
+	raw, err = toRaw(nil)
+	ensure.Nil(t, err)
+	elems, err := raw.Elements()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(elems), 0)
+
+	// the ids the driver decodes compare equal to the ones of mgo
+	id := bson.NewObjectId()
+	var driverId primitive.ObjectID
+	copy(driverId[:], id)
+	value, err := fromDriverValue(driverId)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, value, id)
+	value, err = fromDriverValue(int32(1))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, value, 1)
+}
+
+func TestUpsertNamesId(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		query, update bson.D
+		namesId       bool
+	}{
+		{bson.D{{"_id", 1}}, bson.D{{"$inc", bson.D{{"n", 1}}}}, true},
+		{bson.D{{"_id", bson.D{{"$in", []interface{}{1, 2}}}}}, bson.D{{"$inc", bson.D{{"n", 1}}}}, false},
+		{bson.D{{"name", "x"}}, bson.D{{"_id", 1}, {"name", "x"}}, true},
+		{bson.D{{"name", "x"}}, bson.D{{"$setOnInsert", bson.D{{"_id", 1}}}}, true},
+		{bson.D{{"name", "x"}}, bson.D{{"$set", bson.D{{"n", 1}}}}, false},
+		{bson.D{{"name", "x"}}, bson.D{{"name", "y"}}, false},
+	}
+	for _, c := range cases {
+		op := &Op{Type: Update, Upsert: true, QueryDoc: c.query, UpdateDoc: c.update}
+		ensure.DeepEqual(t, upsertNamesId(op), c.namesId, c.query, c.update)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ParsePlatform/flashback"
+)
+
+// serveControl exposes an http endpoint to control a running replay. addr is
+// either a tcp address or "unix:" followed by the path of a unix socket.
+//
+//	POST /pause, /resume             hold or resume dispatching ops
+//	POST /stop                       finish the in-flight ops and stop
+//	POST /speedup?value=<speedup>    change the speedup ("real" style)
+//	POST /rate?value=<ops/sec>       change the target rate ("stress" style)
+//	POST /workers?value=<workers>    change the number of workers
+//	GET  /status                     print the current settings
+func serveControl(addr string, replayer *flashback.Replayer) error {
+	control := replayer.Control()
+	var (
+		listener net.Listener
+		err      error
+	)
+	if strings.HasPrefix(addr, "unix:") {
+		listener, err = net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	handle := func(path string, action func(r *http.Request) error) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := action(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Infof("Control: %s %s", path, r.URL.RawQuery)
+			fmt.Fprintln(w, "ok")
+		})
+	}
+	value := func(r *http.Request) (float64, error) {
+		return strconv.ParseFloat(r.URL.Query().Get("value"), 64)
+	}
+
+	handle("/pause", func(r *http.Request) error {
+		control.Pause()
+		return nil
+	})
+	handle("/resume", func(r *http.Request) error {
+		control.Resume()
+		return nil
+	})
+	handle("/stop", func(r *http.Request) error {
+		replayer.Stop()
+		return nil
+	})
+	handle("/speedup", func(r *http.Request) error {
+		speedup, err := value(r)
+		if err != nil {
+			return err
+		}
+		return control.SetSpeedup(speedup)
+	})
+	handle("/rate", func(r *http.Request) error {
+		rate, err := value(r)
+		if err != nil {
+			return err
+		}
+		return control.SetRate(rate)
+	})
+	handle("/workers", func(r *http.Request) error {
+		workers, err := strconv.Atoi(r.URL.Query().Get("value"))
+		if err != nil {
+			return err
+		}
+		return replayer.SetWorkers(workers)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "paused: %t\nstopped: %t\nspeedup: %f\nrate: %.2f\nworkers: %d\n",
+			control.Paused(), control.Stopped(), control.Speedup(), control.Rate(), replayer.Workers())
+	})
+
+	logger.Infof("Serving control requests on %s", addr)
+	go http.Serve(listener, mux)
+	return nil
+}
@@ -5,14 +5,15 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ParsePlatform/flashback"
-	"gopkg.in/mgo.v2"
 )
 
 func panicOnError(err error) {
@@ -26,11 +27,28 @@ var (
 	numSkipOps               int
 	opsFilename              string
 	slowOpThresholdMs        int
+	slowOpThresholds         string
+	slowOpsFilename          string
+	slowOpTypeThresholds     map[flashback.OpType]time.Duration
+	slowOpNsThresholds       map[string]time.Duration
 	socketTimeout            int64
+	maxTimeMs                string
+	maxTimes                 map[flashback.OpType]time.Duration
+	opDeadlineMs             int
+	retryMaxAttempts         int
+	retryBackoff             time.Duration
+	retryMaxBackoff          time.Duration
+	retryJitter              float64
+	retryOn                  string
+	retryCategories          []flashback.ErrorCategory
 	startTime                int64
 	style                    string
 	cyclic                   bool
 	url                      string
+	driver                   string
+	challengerDriver         string
+	challengerDriver2        string
+	challengerDriver3        string
 	challengerUrl            string
 	challengerUrl2           string
 	challengerUrl3           string
@@ -45,8 +63,119 @@ var (
 	challengerStatsFilename3 string
 	opFilter                 string
 	speedup                  float64
+	lateOpThresholdMs        int
+	lateOpPolicy             string
+	maxIdleGapMs             int
+	preserveClientOrder      bool
+	emulateConcurrency       string
+	amplify                  int
+	amplifyOffsetMs          int
+	amplifyRewriteKeys       string
+	rate                     float64
+	controlAddr              string
+	shutdownTimeout          time.Duration
+	warmup                   time.Duration
+	warmupOps                int64
+	runDuration              time.Duration
+	nodeConfigFilename       string
+	pipeline                 string
+	verifyResults            bool
+	verifyWrites             bool
+	checkDivergence          bool
+	dryRun                   bool
+	explainFilename          string
+	divergenceSampleIds      int
+	verifyIgnoreOrder        bool
+	verifyIgnoreFields       string
+	mismatchFilename         string
+	failedOpsFilename        string
+	nodes                    nodeFlags
+	routes                   routeFlags
+	writeConcerns            writeConcernFlags
+	honorWriteConcern        bool
+	readConcern              string
+	readConcerns             map[string]string
 )
 
+// nodeFlags collects the nodes given with repeated `node` flags
+type nodeFlags []flashback.NodeConfig
+
+func (n *nodeFlags) String() string {
+	names := make([]string, len(*n))
+	for i, node := range *n {
+		names[i] = node.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (n *nodeFlags) Set(value string) error {
+	node, err := flashback.ParseNodeConfig(value)
+	if err != nil {
+		return err
+	}
+	*n = append(*n, node)
+	return nil
+}
+
+// routeFlags collects the rules given with repeated `route` flags
+type routeFlags []flashback.RouteRule
+
+func (r *routeFlags) String() string {
+	return fmt.Sprintf("%d routes", len(*r))
+}
+
+func (r *routeFlags) Set(value string) error {
+	rule, err := flashback.ParseRouteRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// writeConcernFlags collects the write concerns given with repeated
+// `write_concern` flags
+type writeConcernFlags struct {
+	global      flashback.WriteConcern
+	byNamespace map[string]flashback.WriteConcern
+}
+
+func (w *writeConcernFlags) String() string {
+	return fmt.Sprintf("%d write concerns", len(w.byNamespace))
+}
+
+func (w *writeConcernFlags) Set(value string) error {
+	namespace := ""
+	if parts := strings.SplitN(value, ":", 2); len(parts) == 2 {
+		namespace, value = parts[0], parts[1]
+		if !strings.Contains(namespace, ".") {
+			return fmt.Errorf("%q is not a namespace", namespace)
+		}
+	}
+	writeConcern, err := flashback.ParseWriteConcern(value)
+	if err != nil {
+		return err
+	}
+	if namespace == "" {
+		w.global = writeConcern
+		return nil
+	}
+	if w.byNamespace == nil {
+		w.byNamespace = make(map[string]flashback.WriteConcern)
+	}
+	w.byNamespace[namespace] = writeConcern
+	return nil
+}
+
+// The flags that describe the nodes the old way, before `node` and
+// `node_config`
+var legacyNodeFlags = []string{
+	"url", "driver", "statsfilename",
+	"challenger_url", "challenger_driver", "challenger_statsfilename",
+	"challenger_url2", "challenger_driver2", "challenger_statsfilename2",
+	"challenger_url3", "challenger_driver3", "challenger_statsfilename3",
+}
+
 const (
 	// Set one minute timeout on mongo socket connections (nanoseconds) by default
 	defaultMgoSocketTimeout = 60000000000
@@ -61,6 +190,92 @@ func init() {
 		"url",
 		"",
 		"[Optional] The database server's url, in the format of mongodb://[<user>:<password>@]<host>[:<port>]. Defaults to mongodb://localhost:27017")
+	flag.Var(&nodes,
+		"node",
+		"[Optional] A node to replay the ops against, as a comma separated list of settings: "+
+			"name, url, stats_filename, driver, socket_timeout, username, password, auth_source, auth_mechanism, "+
+			"direct, pool_limit and connect_timeout. I.e. \"name=challenger,url=mongodb://host:27017,driver=mongo-driver\". "+
+			"Can be repeated, the first node is the reference one. Replaces `url` and the `challenger_*` options.")
+	flag.StringVar(&nodeConfigFilename,
+		"node_config",
+		"",
+		"[Optional] A json file that describes the nodes to replay the ops against, with the same settings as `node`: "+
+			"{\"nodes\": [{\"name\": \"default\", \"url\": \"mongodb://localhost:27017\", \"socket_timeout\": \"10s\"}, ...]}. "+
+			"The nodes of `node` flags come after the ones of the file.")
+	flag.StringVar(&pipeline,
+		"pipeline",
+		string(flashback.LockStepPipeline),
+		"[Optional] How the nodes share the ops. You can choose: \n"+
+			"	lockstep: each op runs on all the nodes at the same time, and the next op waits for the slowest node\n"+
+			"	independent: each node gets its own dispatcher and `workers` workers, fed from a shared reader, "+
+			"so that each node's throughput and latency are measured independently")
+	flag.BoolVar(&verifyResults,
+		"verify_results",
+		false,
+		"[Optional] Compare the results of queries, counts and findAndModify on the challengers to the ones of "+
+			"the reference node, and count the mismatches. Only with the \"lockstep\" pipeline.")
+	flag.BoolVar(&verifyWrites,
+		"verify_writes",
+		false,
+		"[Optional] Compare the number of documents that updates and removes matched, modified and removed "+
+			"on the challengers to the ones on the reference node, and count the mismatches. Only with the "+
+			"\"lockstep\" pipeline.")
+	flag.BoolVar(&verifyIgnoreOrder,
+		"verify_ignore_order",
+		false,
+		"[Optional] With `verify_results`, compare the documents of queries regardless of their order.")
+	flag.StringVar(&verifyIgnoreFields,
+		"verify_ignore_fields",
+		"",
+		"[Optional] With `verify_results`, a comma separated list of fields (i.e. \"updatedAt,meta.version\") "+
+			"that are left out of the comparison.")
+	flag.StringVar(&mismatchFilename,
+		"mismatch_filename",
+		"",
+		"[Optional] With `verify_results` or `verify_writes`, write a sample of the mismatches to this file.")
+	flag.StringVar(&failedOpsFilename,
+		"failed_ops_filename",
+		"",
+		"[Optional] Write every op that fails on any node to this BSON file, along with the node, the error "+
+			"and the latency. The file can be passed as `ops_filename` to replay the failures again.")
+	flag.BoolVar(&dryRun,
+		"dry_run",
+		false,
+		"[Optional] Go through the ops without connecting to any node, and print how many of them would be "+
+			"executed, skipped or fail, by type and namespace.")
+	flag.StringVar(&explainFilename,
+		"explain_filename",
+		"",
+		"[Optional] Once the replay is over, run explain on every node for each query shape, and write the "+
+			"winning plans to this file. The shapes whose plan differs between nodes are logged.")
+	flag.BoolVar(&checkDivergence,
+		"check_divergence",
+		false,
+		"[Optional] Once the replay is over, hash every collection that the ops touched on every node, "+
+			"and report the ones whose data differs from the reference node.")
+	flag.IntVar(&divergenceSampleIds,
+		"divergence_sample_ids",
+		0,
+		"[Optional] With `check_divergence`, compare the documents of the collections that diverged, and "+
+			"report up to this many of the _ids that differ. Keeps the _ids of a whole collection in memory.")
+	flag.StringVar(&driver,
+		"driver",
+		flashback.MgoDriver,
+		"[Optional] The driver the ops are executed with on the database server. You can choose: \n"+
+			"	mgo: the legacy mgo driver\n"+
+			"	mongo-driver: the official MongoDB Go driver, which supports OP_MSG, sessions and newer auth")
+	flag.StringVar(&challengerDriver,
+		"challenger_driver",
+		flashback.MgoDriver,
+		"[Optional] Like `driver`, for the challenger.")
+	flag.StringVar(&challengerDriver2,
+		"challenger_driver2",
+		flashback.MgoDriver,
+		"[Optional] Like `driver`, for the challenger2.")
+	flag.StringVar(&challengerDriver3,
+		"challenger_driver3",
+		flashback.MgoDriver,
+		"[Optional] Like `driver`, for the challenger3.")
 	flag.StringVar(&challengerUrl,
 		"challenger_url",
 		"",
@@ -90,6 +305,29 @@ func init() {
 		1.0,
 		"This option is for \"real\" style. Instead of replaying ops realtime, you can use this option "+
 			"to speedup or slowdown execution. For example, setting speedup to 2 will send ops 2x faster")
+	flag.IntVar(&lateOpThresholdMs,
+		"late_op_threshold_ms",
+		0,
+		"[Optional] This option is for \"real\" style. Once the replay falls behind the (scaled) timestamps "+
+			"of the ops by more than late_op_threshold_ms, late_op_policy kicks in. Turned off by default.")
+	flag.StringVar(&lateOpPolicy,
+		"late_op_policy",
+		string(flashback.LateOpContinue),
+		"[Optional] What to do with ops that are later than late_op_threshold_ms. You can choose: \n"+
+			"	continue: replay them anyway\n"+
+			"	drop: skip them and count them as dropped\n"+
+			"	abort: stop the replay")
+	flag.IntVar(&maxIdleGapMs,
+		"max_idle_gap_ms",
+		0,
+		"[Optional] This option is for \"real\" style. Any gap between two consecutive ops that is longer than "+
+			"max_idle_gap_ms (before speedup) is shortened to max_idle_gap_ms, while the timing of the other ops "+
+			"is kept. Turned off by default.")
+	flag.Float64Var(&rate,
+		"rate",
+		0,
+		"[Optional] This option is for \"stress\" style. Limit the replay to this many ops/sec. "+
+			"Not limited by default.")
 	flag.BoolVar(&cyclic,
 		"cyclic",
 		false,
@@ -98,6 +336,34 @@ func init() {
 		"workers",
 		10,
 		"[Optional] Number of workers that sends ops to database.")
+	flag.BoolVar(&preserveClientOrder,
+		"preserve_client_order",
+		false,
+		"[Optional] If true, all the ops recorded from the same client are replayed by the same worker, "+
+			"in their original order. Otherwise ops go to whichever worker is free.")
+	flag.StringVar(&emulateConcurrency,
+		"emulate_concurrency",
+		"",
+		"[Optional] Instead of using a fixed number of workers, infer the concurrency from the recorded ops. "+
+			"You can choose: \n"+
+			"	clients: one worker per recorded client, which replays that client's ops in order. The profiler "+
+			"only records the client's address, so all the connections of a host share a worker\n"+
+			"	overlap: as many workers as the largest number of recorded ops running at the same time\n"+
+			"Overrides `workers`.")
+	flag.IntVar(&amplify,
+		"amplify",
+		1,
+		"[Optional] Replay the ops as this many concurrent copies, to simulate a heavier workload.")
+	flag.IntVar(&amplifyOffsetMs,
+		"amplify_offset_ms",
+		0,
+		"[Optional] With `amplify`, copy N of the ops is shifted in time by N * amplify_offset_ms.")
+	flag.StringVar(&amplifyRewriteKeys,
+		"amplify_rewrite_keys",
+		"",
+		"[Optional] With `amplify`, a comma separated list of keys (i.e. \"_id,email\") whose values are made "+
+			"distinct for each copy, so that the inserts of the copies don't collide. Only string and ObjectId "+
+			"values are rewritten.")
 	flag.IntVar(&maxOps,
 		"maxOps",
 		math.MaxUint32, // default value for maxOps is maxUint32
@@ -109,14 +375,94 @@ func init() {
 		0,
 		"[Optional] Skip first N ops. Useful for when the total ops in ops_filename"+
 			" exceeds available memory and you're running in stress mode.")
+	flag.DurationVar(&warmup,
+		"warmup",
+		0,
+		"[Optional] Ops executed during this first stretch of the replay (i.e. 5m) are left out of the stats, "+
+			"so that cold caches don't skew them. Turned off by default.")
+	flag.Int64Var(&warmupOps,
+		"warmup_ops",
+		0,
+		"[Optional] Like `warmup`, but leaves the first warmup_ops ops out of the stats. If both are set, "+
+			"the warmup lasts until both are reached.")
 	flag.Int64Var(&socketTimeout,
 		"socketTimeout",
 		defaultMgoSocketTimeout,
 		"[Optional] Mongo socket timeout in nanoseconds.")
+	flag.StringVar(&maxTimeMs,
+		"max_time_ms",
+		"",
+		"[Optional] Server-side time limit of queries, counts and findAndModify, sent as their maxTimeMS. "+
+			"Either a number of milliseconds for all of them, or a comma separated list of op types and "+
+			"milliseconds, i.e. \"query=500,command.count=1000\". Turned off by default.")
+	flag.IntVar(&opDeadlineMs,
+		"op_deadline_ms",
+		0,
+		"[Optional] Client-side time limit of every op. The ops that go over it are counted as timeouts, "+
+			"without waiting for the node. Turned off by default.")
+	flag.Var(&routes,
+		"route",
+		"[Optional] Send the ops that match a rule to a read preference mode, or to a session of their own, "+
+			"as a comma separated list of settings: "+
+			"type=<op type>,namespace=<db or db.collection>,host=<recorded host>,mode=<mode>,session=<name>. "+
+			"The modes are primary, primaryPreferred, secondary, secondaryPreferred, nearest, and recorded, "+
+			"which replays the read preference of the recorded op. Modes only apply to queries and counts. "+
+			"Can be repeated, the first rule that matches an op wins.")
+	flag.Var(&writeConcerns,
+		"write_concern",
+		"[Optional] How the writes are acknowledged, as a comma separated list of settings: "+
+			"w=<number, majority or tag set>,j=<true or false>,wtimeout=<duration>, or \"unacknowledged\". "+
+			"Prefix it with a namespace and a colon to only use it there, i.e. \"db.logs:w=1\". "+
+			"Can be repeated. Defaults to the one of the driver.")
+	flag.BoolVar(&honorWriteConcern,
+		"honor_recorded_write_concern",
+		false,
+		"[Optional] Replay the writes that were recorded with a write concern with that one instead of "+
+			"`write_concern`.")
+	flag.StringVar(&readConcern,
+		"read_concern",
+		"",
+		"[Optional] The read concern level of queries and counts: local, available, majority, linearizable "+
+			"or snapshot. Namespaces can have a level of their own, in a comma separated list, "+
+			"i.e. \"majority,db.logs=local\". Only works with the mongo-driver driver.")
+	flag.IntVar(&retryMaxAttempts,
+		"retry_max_attempts",
+		flashback.DefaultRetryPolicy.MaxAttempts,
+		"[Optional] How many times an op that fails with one of the `retry_on` errors runs at most, the "+
+			"first one included. 1 turns retries off.")
+	flag.DurationVar(&retryBackoff,
+		"retry_backoff",
+		0,
+		"[Optional] How long to wait before retrying an op (i.e. 100ms), doubled after each retry. "+
+			"Retries right away by default.")
+	flag.DurationVar(&retryMaxBackoff,
+		"retry_max_backoff",
+		0,
+		"[Optional] The longest wait between two retries. Not capped by default.")
+	flag.Float64Var(&retryJitter,
+		"retry_jitter",
+		0,
+		"[Optional] Randomize the waits between retries by up to this fraction of them (i.e. 0.2).")
+	flag.StringVar(&retryOn,
+		"retry_on",
+		"network,not_primary",
+		"[Optional] A comma separated list of the errors that are worth retrying. You can choose: \n"+
+			"	network, timeout, not_primary, duplicate_key, auth, server, other")
 	flag.IntVar(&slowOpThresholdMs,
 		"slow_op_threshold_ms",
 		0,
 		"[Optional] All ops that take longer than slow_op_threshold_ms will be logged. Turned off by default.")
+	flag.StringVar(&slowOpThresholds,
+		"slow_op_thresholds",
+		"",
+		"[Optional] Override `slow_op_threshold_ms` for some op types or namespaces, with a comma separated "+
+			"list of op types or namespaces and milliseconds, i.e. \"query=100,command.count=500,db.users=50\". "+
+			"The threshold of a namespace wins over the one of an op type, and 0 leaves their ops out.")
+	flag.StringVar(&slowOpsFilename,
+		"slow_ops_filename",
+		"",
+		"[Optional] Write the slow ops to this BSON file, with their query, update or command and their "+
+			"latency on every node. The file can be passed as `ops_filename` to replay them again.")
 	flag.BoolVar(&verbose,
 		"verbose",
 		false,
@@ -130,6 +476,22 @@ func init() {
 		"stderr",
 		"",
 		"[Optional] Write error/warning log messages to specified file, instead of stderr.")
+	flag.StringVar(&controlAddr,
+		"control_addr",
+		"",
+		"[Optional] Address to serve control requests on, i.e. localhost:8089 or unix:/tmp/flashback.sock. "+
+			"Allows to pause, resume, stop, and change the speedup, rate or number of workers of a running replay. "+
+			"See cmd/flashback/control.go for the endpoints. Turned off by default.")
+	flag.DurationVar(&runDuration,
+		"duration",
+		0,
+		"[Optional] Stop the replay after this long (i.e. 20m), whatever the number of ops left. "+
+			"In-flight ops are given `shutdown_timeout` to finish. Not limited by default.")
+	flag.DurationVar(&shutdownTimeout,
+		"shutdown_timeout",
+		30*time.Second,
+		"[Optional] On SIGINT/SIGTERM, or once `duration` is over, how long to wait for in-flight ops to finish "+
+			"before the final report.")
 	flag.StringVar(&stdout,
 		"stdout",
 		"",
@@ -156,10 +518,145 @@ func init() {
 		"[Optional] If specified, we'll only execute ops of that particular type")
 }
 
+func anyFlagSet(names []string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if f.Name == name {
+				set = true
+			}
+		}
+	})
+	return set
+}
+
+func validDriver(driver string) bool {
+	return driver == flashback.MgoDriver || driver == flashback.MongoGoDriver
+}
+
+// parseMaxTimes reads either a number of milliseconds for all the op types
+// that take a maxTimeMS, or a list of op types and milliseconds
+func parseMaxTimes(value string) (map[flashback.OpType]time.Duration, error) {
+	maxTimes := make(map[flashback.OpType]time.Duration)
+	if value == "" {
+		return maxTimes, nil
+	}
+	if ms, err := strconv.Atoi(value); err == nil {
+		if ms < 0 {
+			return nil, fmt.Errorf("%d must not be negative", ms)
+		}
+		for _, opType := range []flashback.OpType{flashback.Query, flashback.Count, flashback.FindAndModify} {
+			maxTimes[opType] = time.Duration(ms) * time.Millisecond
+		}
+		return maxTimes, nil
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected <op type>=<ms>, got %q", item)
+		}
+		opType := flashback.OpType(parts[0])
+		if opType != flashback.Query && opType != flashback.Count && opType != flashback.FindAndModify {
+			return nil, fmt.Errorf("%q ops don't take a maxTimeMS, only %q, %q and %q do", opType,
+				flashback.Query, flashback.Count, flashback.FindAndModify)
+		}
+		ms, err := strconv.Atoi(parts[1])
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("invalid number of milliseconds %q for %q ops", parts[1], opType)
+		}
+		maxTimes[opType] = time.Duration(ms) * time.Millisecond
+	}
+	return maxTimes, nil
+}
+
+// parseRetryOn reads a list of error categories
+func parseRetryOn(value string) ([]flashback.ErrorCategory, error) {
+	var categories []flashback.ErrorCategory
+	if value == "" {
+		return categories, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		valid := false
+		for _, category := range flashback.AllErrorCategories {
+			if flashback.ErrorCategory(item) == category {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown error category %q", item)
+		}
+		categories = append(categories, flashback.ErrorCategory(item))
+	}
+	return categories, nil
+}
+
+// parseSlowOpThresholds reads a list of op types or namespaces and
+// milliseconds
+func parseSlowOpThresholds(value string) (map[flashback.OpType]time.Duration, map[string]time.Duration, error) {
+	byType := make(map[flashback.OpType]time.Duration)
+	byNamespace := make(map[string]time.Duration)
+	if value == "" {
+		return byType, byNamespace, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("expected <op type or namespace>=<ms>, got %q", item)
+		}
+		ms, err := strconv.Atoi(parts[1])
+		if err != nil || ms < 0 {
+			return nil, nil, fmt.Errorf("invalid number of milliseconds %q for %q", parts[1], parts[0])
+		}
+		threshold := time.Duration(ms) * time.Millisecond
+
+		isOpType := false
+		for _, opType := range flashback.AllOpTypes {
+			if flashback.OpType(parts[0]) == opType {
+				isOpType = true
+			}
+		}
+		if isOpType {
+			byType[flashback.OpType(parts[0])] = threshold
+		} else if strings.Contains(parts[0], ".") {
+			byNamespace[parts[0]] = threshold
+		} else {
+			return nil, nil, fmt.Errorf("%q is neither an op type nor a namespace", parts[0])
+		}
+	}
+	return byType, byNamespace, nil
+}
+
+// parseReadConcerns reads a comma separated list of read concern levels,
+// where "<namespace>=<level>" overrides the level of a namespace
+func parseReadConcerns(value string) (string, map[string]string, error) {
+	global, byNamespace := "", make(map[string]string)
+	if value == "" {
+		return global, byNamespace, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) == 1 {
+			global = parts[0]
+		} else if strings.Contains(parts[0], ".") {
+			byNamespace[parts[0]] = parts[1]
+		} else {
+			return "", nil, fmt.Errorf("%q is not a namespace", parts[0])
+		}
+	}
+	return global, byNamespace, nil
+}
+
 func parseFlags() error {
 	flag.Parse()
 	validArgs := true
 	errorMsg := ""
+	var maxTimesErr error
+	maxTimes, maxTimesErr = parseMaxTimes(maxTimeMs)
+	var retryOnErr, slowOpThresholdsErr, readConcernErr error
+	retryCategories, retryOnErr = parseRetryOn(retryOn)
+	slowOpTypeThresholds, slowOpNsThresholds, slowOpThresholdsErr = parseSlowOpThresholds(slowOpThresholds)
+	readConcern, readConcerns, readConcernErr = parseReadConcerns(readConcern)
 
 	if style == "" {
 		validArgs = false
@@ -173,6 +670,71 @@ func parseFlags() error {
 	} else if workers <= 0 {
 		validArgs = false
 		errorMsg = "The `workers` argument must be a positive number."
+	} else if emulateConcurrency != "" && emulateConcurrency != "clients" && emulateConcurrency != "overlap" {
+		validArgs = false
+		errorMsg = "Invalid `emulate_concurrency` argument passed to program: " + emulateConcurrency + ". The only acceptable values are \"clients\" and \"overlap\"."
+	} else if speedup <= 0 {
+		validArgs = false
+		errorMsg = "The `speedup` argument must be a positive number."
+	} else if rate < 0 {
+		validArgs = false
+		errorMsg = "The `rate` argument must not be negative."
+	} else if runDuration < 0 {
+		validArgs = false
+		errorMsg = "The `duration` argument must not be negative."
+	} else if warmup < 0 || warmupOps < 0 {
+		validArgs = false
+		errorMsg = "The `warmup` and `warmup_ops` arguments must not be negative."
+	} else if amplify <= 0 {
+		validArgs = false
+		errorMsg = "The `amplify` argument must be a positive number."
+	} else if lateOpThresholdMs < 0 {
+		validArgs = false
+		errorMsg = "The `late_op_threshold_ms` argument must not be negative."
+	} else if maxIdleGapMs < 0 {
+		validArgs = false
+		errorMsg = "The `max_idle_gap_ms` argument must not be negative."
+	} else if opDeadlineMs < 0 {
+		validArgs = false
+		errorMsg = "The `op_deadline_ms` argument must not be negative."
+	} else if retryMaxAttempts < 1 {
+		validArgs = false
+		errorMsg = "The `retry_max_attempts` argument must be a positive number."
+	} else if retryBackoff < 0 || retryMaxBackoff < 0 {
+		validArgs = false
+		errorMsg = "The `retry_backoff` and `retry_max_backoff` arguments must not be negative."
+	} else if retryJitter < 0 || retryJitter > 1 {
+		validArgs = false
+		errorMsg = "The `retry_jitter` argument must be between 0 and 1."
+	} else if slowOpThresholdsErr != nil {
+		validArgs = false
+		errorMsg = "Invalid `slow_op_thresholds` argument passed to program: " + slowOpThresholdsErr.Error()
+	} else if readConcernErr != nil {
+		validArgs = false
+		errorMsg = "Invalid `read_concern` argument passed to program: " + readConcernErr.Error()
+	} else if retryOnErr != nil {
+		validArgs = false
+		errorMsg = "Invalid `retry_on` argument passed to program: " + retryOnErr.Error()
+	} else if pipeline != string(flashback.LockStepPipeline) && pipeline != string(flashback.IndependentPipelines) {
+		validArgs = false
+		errorMsg = "Invalid `pipeline` argument passed to program: " + pipeline + ". The only acceptable values are \"lockstep\" and \"independent\"."
+	} else if (verifyResults || verifyWrites) && pipeline != string(flashback.LockStepPipeline) {
+		validArgs = false
+		errorMsg = "The `verify_results` and `verify_writes` arguments require the \"lockstep\" pipeline."
+	} else if (len(nodes) > 0 || nodeConfigFilename != "") && anyFlagSet(legacyNodeFlags) {
+		validArgs = false
+		errorMsg = "The `node` and `node_config` arguments can't be combined with `url`, `driver`, `statsfilename` " +
+			"or the `challenger_*` arguments."
+	} else if !validDriver(driver) || !validDriver(challengerDriver) || !validDriver(challengerDriver2) ||
+		!validDriver(challengerDriver3) {
+		validArgs = false
+		errorMsg = "Invalid driver passed to program. The only acceptable values are \"mgo\" and \"mongo-driver\"."
+	} else if maxTimesErr != nil {
+		validArgs = false
+		errorMsg = "Invalid `max_time_ms` argument passed to program: " + maxTimesErr.Error()
+	} else if _, err := flashback.NewReplaySchedule(0, flashback.LateOpPolicy(lateOpPolicy)); err != nil {
+		validArgs = false
+		errorMsg = "Invalid `late_op_policy` argument passed to program: " + lateOpPolicy + ". The only acceptable values are \"continue\", \"drop\" and \"abort\"."
 	}
 
 	if !validArgs {
@@ -189,56 +751,26 @@ func parseFlags() error {
 	return nil
 }
 
-func makeOpsChan(style string, opsFilename string, logger *flashback.Logger) (chan *flashback.Op, error) {
-	// Prepare to dispatch ops
-	var (
-		reader flashback.OpsReader
-		err    error
-	)
-
-	if style == "real" && cyclic == true {
-		reader = flashback.NewCyclicOpsReader(func() flashback.OpsReader {
-			err, reader := flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
-			panicOnError(err)
-			return reader
-		}, logger)
-	} else {
-		err, reader = flashback.NewFileByLineOpsReader(opsFilename, logger, opFilter)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	if startTime > 0 {
-		if _, err := reader.SetStartTime(startTime); err != nil {
-			return nil, err
-		}
+// legacyNodes creates the "default" node, and the "challenger" nodes if
+// necessary
+func legacyNodes() []flashback.NodeConfig {
+	nodes := []flashback.NodeConfig{{Name: "default", Url: url, StatsFilename: statsFilename, Driver: driver}}
+	if challengerUrl != "" {
+		nodes = append(nodes,
+			flashback.NodeConfig{Name: "challenger", Url: challengerUrl, StatsFilename: challengerStatsFilename,
+				Driver: challengerDriver})
 	}
-	if numSkipOps > 0 {
-		if err := reader.SkipOps(numSkipOps); err != nil {
-			return nil, err
-		}
+	if challengerUrl2 != "" {
+		nodes = append(nodes,
+			flashback.NodeConfig{Name: "challenger2", Url: challengerUrl2, StatsFilename: challengerStatsFilename2,
+				Driver: challengerDriver2})
 	}
-
-	if style == "stress" {
-		return flashback.NewBestEffortOpsDispatcher(reader, maxOps, logger), nil
-	} else {
-		return flashback.NewByTimeOpsDispatcher(reader, maxOps, logger, speedup), nil
+	if challengerUrl3 != "" {
+		nodes = append(nodes,
+			flashback.NodeConfig{Name: "challenger3", Url: challengerUrl3, StatsFilename: challengerStatsFilename3,
+				Driver: challengerDriver3})
 	}
-}
-
-type node struct {
-	name          string
-	url           string
-	statsFile     *os.File
-	statsChan     chan flashback.OpStat
-	statsAnalyzer *flashback.StatsAnalyzer
-}
-
-type nodeWorkerState struct {
-	name    string
-	session *mgo.Session
-	exec    *flashback.OpsExecutor
+	return nodes
 }
 
 func main() {
@@ -248,197 +780,112 @@ func main() {
 	panicOnError(err)
 	defer logger.Close()
 
-	opsChan, err := makeOpsChan(style, opsFilename, logger)
-	panicOnError(err)
-
-	createNode := func(name string, nodeUrl string, filename string) node {
-		var n node
-		// stats file
-		if filename != "" {
-			var err error
-			n.statsFile, err = os.Create(filename)
-			panicOnError(err)
-		} else {
-			n.statsFile = nil
-		}
-		n.name = name
-		n.url = nodeUrl
-		n.statsChan = make(chan flashback.OpStat, workers*100)
-		n.statsAnalyzer = flashback.NewStatsAnalyzer(n.statsChan)
-		return n
+	config := flashback.ReplayConfig{
+		Style:               flashback.ReplayStyle(style),
+		OpsFilename:         opsFilename,
+		MaxOps:              maxOps,
+		NumSkipOps:          numSkipOps,
+		StartTime:           startTime,
+		OpFilter:            opFilter,
+		Cyclic:              cyclic,
+		Speedup:             speedup,
+		Rate:                rate,
+		LateOpThreshold:     time.Duration(lateOpThresholdMs) * time.Millisecond,
+		LateOpPolicy:        flashback.LateOpPolicy(lateOpPolicy),
+		MaxIdleGap:          time.Duration(maxIdleGapMs) * time.Millisecond,
+		Workers:             workers,
+		Pipeline:            flashback.PipelineMode(pipeline),
+		PreserveClientOrder: preserveClientOrder,
+		EmulateConcurrency:  flashback.ConcurrencyMode(emulateConcurrency),
+		Amplify:             amplify,
+		AmplifyOffset:       time.Duration(amplifyOffsetMs) * time.Millisecond,
+		Warmup:              warmup,
+		WarmupOps:           warmupOps,
+		Duration:            runDuration,
+		ShutdownTimeout:     shutdownTimeout,
+		SocketTimeout:       time.Duration(socketTimeout),
+		MaxTime:             maxTimes,
+		OpDeadline:          time.Duration(opDeadlineMs) * time.Millisecond,
+		SlowOpThreshold:     time.Duration(slowOpThresholdMs) * time.Millisecond,
+		SlowOpsFilename:     slowOpsFilename,
+		ExplainFilename:     explainFilename,
+		FailedOpsFilename:   failedOpsFilename,
+		Verbose:             verbose,
+		Retry: &flashback.RetryPolicy{
+			MaxAttempts: retryMaxAttempts,
+			Backoff:     retryBackoff,
+			MaxBackoff:  retryMaxBackoff,
+			Jitter:      retryJitter,
+			RetryOn:     retryCategories,
+		},
 	}
-
-	var nodes []node
-	// create "default" node
-	nodes = append(nodes, createNode("default", url, statsFilename))
-	// create "challenger" node if necessary
-	if challengerUrl != "" {
-		nodes = append(nodes, createNode("challenger", challengerUrl, challengerStatsFilename))
+	config.Routes = routes
+	config.SlowOpThresholdByType = slowOpTypeThresholds
+	config.SlowOpThresholdByNamespace = slowOpNsThresholds
+	config.WriteConcern = writeConcerns.global
+	config.WriteConcernByNamespace = writeConcerns.byNamespace
+	config.HonorRecordedWriteConcern = honorWriteConcern
+	config.ReadConcern = readConcern
+	config.ReadConcernByNamespace = readConcerns
+	if checkDivergence {
+		config.CheckDivergence = true
+		config.MaxDivergenceSampleIds = divergenceSampleIds
 	}
-	// create "challenger2" node if necessary
-	if challengerUrl2 != "" {
-		nodes = append(nodes, createNode("challenger2", challengerUrl2, challengerStatsFilename2))
+	if verifyResults || verifyWrites {
+		config.Verifier = &flashback.ResultVerifier{
+			Reads:       verifyResults,
+			Writes:      verifyWrites,
+			IgnoreOrder: verifyIgnoreOrder,
+		}
+		if verifyIgnoreFields != "" {
+			config.Verifier.IgnoreFields = strings.Split(verifyIgnoreFields, ",")
+		}
+		config.MismatchFilename = mismatchFilename
 	}
-	// create "challenger3" node if necessary
-	if challengerUrl3 != "" {
-		nodes = append(nodes, createNode("challenger3", challengerUrl3, challengerStatsFilename3))
+	if amplifyRewriteKeys != "" {
+		config.AmplifyRewriteKeys = strings.Split(amplifyRewriteKeys, ",")
 	}
 
-	// close stats files
-	for _, n := range nodes {
-		if n.statsFile != nil {
-			defer n.statsFile.Close()
-		}
+	if nodeConfigFilename != "" {
+		config.Nodes, err = flashback.LoadNodeConfigs(nodeConfigFilename)
+		panicOnError(err)
 	}
-
-	// Set up workers to do the job
-	exit := make(chan int)
-	opsExecuted := int64(0)
-	fetch := func(id int) {
-		logger.Infof("Worker #%d report for duty\n", id)
-
-		workerStates := make([]nodeWorkerState, len(nodes))
-
-		for i, n := range nodes {
-			dialInfo, err := mgo.ParseURL(n.url)
-			panicOnError(err)
-			session, err := mgo.DialWithInfo(dialInfo)
-			panicOnError(err)
-			session.SetSocketTimeout(time.Duration(socketTimeout))
-			defer session.Close()
-			workerStates[i] = nodeWorkerState{
-				n.name,
-				session,
-				flashback.NewOpsExecutor(session, n.statsChan, logger),
-			}
-		}
-
-		for {
-			op := <-opsChan
-			if op == nil {
-				break
-			}
-			op = flashback.CanonicalizeOp(op)
-			if op == nil {
-				continue
-			}
-
-			var wg sync.WaitGroup
-			wg.Add(len(nodes))
-
-			execute := func(executor *flashback.OpsExecutor, name string) {
-				defer wg.Done()
-				err := executor.Execute(op)
-				if err != nil {
-					if verbose == true {
-						logger.Error(fmt.Sprintf(
-							"[%s] error executing op - type:%s,database:%s,collection:%s,error:%s", name,
-							op.Type, op.Database, op.Collection, err))
-					} else if strings.HasPrefix(err.Error(), "not authorized") {
-						logger.Error(fmt.Sprintf(
-							"[%s] not authorized to execute op - type:%s,database:%s", name, op.Type,
-							op.Database))
-						exit <- 1
-					}
-				}
-			}
-
-			for _, ws := range workerStates {
-				go execute(ws.exec, ws.name)
-			}
-			wg.Wait()
-
-			if slowOpThresholdMs > 0 {
-				isSlow := func(latency time.Duration) bool {
-					return latency > time.Duration(slowOpThresholdMs)*time.Millisecond
-				}
-				wasAnyOpSlow := false
-				for _, ws := range workerStates {
-					if isSlow(ws.exec.LastLatency()) {
-						wasAnyOpSlow = true
-						break
-					}
-				}
-				if wasAnyOpSlow {
-					var timeOutput string
-					for _, ws := range workerStates {
-						timeOutput = fmt.Sprintf("%s %v (%s)", timeOutput, ws.exec.LastLatency(), ws.name)
-					}
-					logger.Infof(fmt.Sprintf("Slow op - %s\ntype:%s,database:%s,collection:%s",
-						timeOutput, op.Type, op.Database, op.Collection))
-				}
-			}
-
-			atomic.AddInt64(&opsExecuted, 1)
-		}
-		exit <- 1
-		logger.Infof("Worker #%d done!\n", id)
+	config.Nodes = append(config.Nodes, nodes...)
+	if len(config.Nodes) == 0 {
+		config.Nodes = legacyNodes()
 	}
-
-	for i := 0; i < workers; i++ {
-		go fetch(i)
+	replayer, err := flashback.NewReplayer(config, logger)
+	panicOnError(err)
+	if dryRun {
+		report, err := replayer.DryRun()
+		panicOnError(err)
+		report.Print(os.Stdout)
+		return
 	}
-
-	report := func() {
-		printStatus := func(status *flashback.ExecutionStatus, statsOut *os.File, name string) {
-			logger.Infof("[%s] Executed %d ops (%d in interval), got %d errors (%d in interval), "+
-				"%.2f ops/sec (total), %.2f ops/sec (interval)", name, status.OpsExecuted, status.IntervalOpsExecuted,
-				status.OpsErrors, status.IntervalOpsErrors, status.OpsPerSec, status.IntervalOpsPerSec)
-
-			var statsLineOutput string
-			if statsOut != nil {
-				timestamp := time.Now().Format("2006-01-02 15:04:05 -0700")
-				statsLineOutput = fmt.Sprintf("%s,%d,%.2f", timestamp, status.IntervalOpsExecuted, status.IntervalOpsPerSec)
-			}
-
-			for _, opType := range flashback.AllOpTypes {
-				latencies := status.Latencies[opType]
-				intervalLatencies := status.IntervalLatencies[opType]
-				logger.Infof("  Op type: %s, count: %d, interval count %d, avg ops/sec: %.2f, interval ops/sec: %.2f",
-					opType, status.Counts[opType], status.IntervalCounts[opType],
-					status.TypeOpsSec[opType], status.IntervalTypeOpsSec[opType])
-				template := "   %s: P50: %.2fms, P70: %.2fms, P90: %.2fms, P95 %.2fms, P99 %.2fms, Max %.2fms\n"
-				logger.Infof(template, "Total", latencies[flashback.P50], latencies[flashback.P70], latencies[flashback.P90],
-					latencies[flashback.P95], latencies[flashback.P99], status.MaxLatency[opType])
-				logger.Infof(template, "Interval", intervalLatencies[flashback.P50], intervalLatencies[flashback.P70],
-					intervalLatencies[flashback.P90], intervalLatencies[flashback.P95], intervalLatencies[flashback.P99],
-					status.IntervalMaxLatency[opType])
-
-				if statsOut != nil {
-					statsLineOutput = fmt.Sprintf("%s,%d,%.2f", statsLineOutput,
-						status.IntervalCounts[opType], status.IntervalTypeOpsSec[opType])
-				}
-			}
-
-			// Write stats to disk at each interval for analysis later
-			// Format is:
-			// time,  ops, ops/sec, insert ops, inserts/sec, update ops, update/sec, remove ops, remove/sec,
-			// query ops, query/sec, count ops, count/sec, fam ops, fam/sec
-			if statsOut != nil {
-				statsOut.WriteString(statsLineOutput + "\n")
-			}
-		}
-
-		for _, n := range nodes {
-			printStatus(n.statsAnalyzer.GetStatus(), n.statsFile, n.name)
-		}
+	panicOnError(replayer.Start())
+	if controlAddr != "" {
+		panicOnError(serveControl(controlAddr, replayer))
 	}
 
-	reportTicker := time.NewTicker(5 * time.Second)
-	// Periodically report execution status
+	// Stop gracefully on SIGINT/SIGTERM, and right away on a second one
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	exitCode := int32(0)
 	go func() {
-		for range reportTicker.C {
-			report()
-		}
+		sig := <-signals
+		logger.Infof("Received %v, stopping", sig)
+		atomic.StoreInt32(&exitCode, 128+int32(sig.(syscall.Signal)))
+		replayer.Stop()
+		sig = <-signals
+		logger.Errorf("Received %v again, not waiting for in-flight ops", sig)
+		replayer.Stop()
 	}()
 
-	// Wait for workers
-	received := 0
-	for received < workers {
-		<-exit
-		received += 1
+	if err := replayer.Wait(); err == flashback.ErrReplayAborted {
+		atomic.StoreInt32(&exitCode, 1)
+	}
+	if code := atomic.LoadInt32(&exitCode); code != 0 {
+		logger.Close()
+		os.Exit(int(code))
 	}
-	reportTicker.Stop()
-	// report one last time
-	report()
 }
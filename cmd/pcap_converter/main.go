@@ -171,6 +171,8 @@ func main() {
 			fbOp := &flashback.Op{
 				Timestamp: op.Seen,
 			}
+			// mongocaputils doesn't tell which tcp flow an op was seen on, so
+			// the ops are left without a Client and aren't sharded by client.
 			// TODO: add mongoproto.OpGetMore (if possible)
 			if opInsert, ok := op.Op.(*mongoproto.OpInsert); ok {
 				err = HandleInsert(fbOp, opInsert, f)
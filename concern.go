@@ -0,0 +1,152 @@
+package flashback
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// WriteConcern is how the writes are acknowledged. The zero value keeps the
+// default of the driver.
+type WriteConcern struct {
+	// How many nodes acknowledge the writes, "majority" or a tag set name.
+	// "0" makes the writes unacknowledged.
+	W string
+	// Wait for the writes to be journaled
+	J        bool
+	WTimeout time.Duration
+}
+
+// Unacknowledged doesn't wait for the writes at all
+var Unacknowledged = WriteConcern{W: "0"}
+
+func (c WriteConcern) isDefault() bool {
+	return c == WriteConcern{}
+}
+
+func (c WriteConcern) unacknowledged() bool {
+	return c.W == "0"
+}
+
+// wNumber is W as a number of nodes, if it is one
+func (c WriteConcern) wNumber() (int, bool) {
+	n, err := strconv.Atoi(c.W)
+	return n, err == nil
+}
+
+func (c WriteConcern) validate() error {
+	if c.isDefault() {
+		return nil
+	}
+	if c.W == "" {
+		return errors.New("a write concern needs a w")
+	}
+	if n, ok := c.wNumber(); ok && n < 0 {
+		return fmt.Errorf("bad w %q in write concern", c.W)
+	}
+	if c.W == "0" && c.J {
+		return errors.New("unacknowledged writes can't be journaled")
+	}
+	if c.WTimeout < 0 {
+		return errors.New("the wtimeout of a write concern must not be negative")
+	}
+	return nil
+}
+
+// document is the writeConcern of a command
+func (c WriteConcern) document() bson.D {
+	var w interface{} = c.W
+	if n, ok := c.wNumber(); ok {
+		w = n
+	}
+	doc := bson.D{{"w", w}}
+	if c.J {
+		doc = append(doc, bson.DocElem{"j", true})
+	}
+	if c.WTimeout > 0 {
+		doc = append(doc, bson.DocElem{"wtimeout", int64(c.WTimeout / time.Millisecond)})
+	}
+	return doc
+}
+
+// ParseWriteConcern reads a write concern like "w=majority,j=true,wtimeout=5s".
+// "unacknowledged" is short for "w=0".
+func ParseWriteConcern(value string) (WriteConcern, error) {
+	var c WriteConcern
+	if value == "unacknowledged" {
+		return Unacknowledged, nil
+	}
+	for _, setting := range strings.Split(value, ",") {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return c, fmt.Errorf("write concern setting %q should look like key=value", setting)
+		}
+		var err error
+		switch kv[0] {
+		case "w":
+			c.W = kv[1]
+		case "j":
+			c.J, err = strconv.ParseBool(kv[1])
+		case "wtimeout":
+			c.WTimeout, err = time.ParseDuration(kv[1])
+		default:
+			return c, fmt.Errorf("unknown write concern setting %q, the only acceptable ones are w, j and wtimeout",
+				kv[0])
+		}
+		if err != nil {
+			return c, fmt.Errorf("bad value for write concern setting %q: %s", kv[0], err)
+		}
+	}
+	return c, c.validate()
+}
+
+// recordedWriteConcern is the write concern an op was sent with, if the
+// recorder kept it, or if it is part of its command
+func recordedWriteConcern(op *Op) (WriteConcern, bool) {
+	doc := op.RecordedWriteConcern
+	if doc == nil {
+		value, _ := GetElem(op.CommandDoc, "writeConcern")
+		doc, _ = value.(bson.D)
+	}
+	if len(doc) == 0 {
+		return WriteConcern{}, false
+	}
+
+	var c WriteConcern
+	if w, ok := GetElem(doc, "w"); ok {
+		if n, err := safeGetInt(w); err == nil {
+			c.W = strconv.Itoa(n)
+		} else if s, ok := w.(string); ok {
+			c.W = s
+		}
+	}
+	if j, ok := GetElem(doc, "j"); ok {
+		c.J, _ = j.(bool)
+	}
+	if wtimeout, ok := GetElem(doc, "wtimeout"); ok {
+		if ms, err := safeGetInt(wtimeout); err == nil {
+			c.WTimeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+	// {j: true} alone waits for the primary
+	if c.W == "" && c.J {
+		c.W = "1"
+	}
+	return c, c.W != "" && c.validate() == nil
+}
+
+// The read concern levels, as named by the server
+var readConcernLevels = []string{"local", "available", "majority", "linearizable", "snapshot"}
+
+func validReadConcern(level string) bool {
+	for _, l := range readConcernLevels {
+		if level == l {
+			return true
+		}
+	}
+	return false
+}
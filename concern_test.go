@@ -0,0 +1,103 @@
+package flashback
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseWriteConcern(t *testing.T) {
+	t.Parallel()
+
+	c, err := ParseWriteConcern("w=majority,j=true,wtimeout=5s")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c, WriteConcern{W: "majority", J: true, WTimeout: 5 * time.Second})
+	ensure.DeepEqual(t, c.document(), bson.D{{"w", "majority"}, {"j", true}, {"wtimeout", int64(5000)}})
+
+	c, err = ParseWriteConcern("w=2")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c.document(), bson.D{{"w", 2}})
+
+	c, err = ParseWriteConcern("unacknowledged")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, c, Unacknowledged)
+
+	for _, value := range []string{"", "w", "j=true", "w=-1", "w=0,j=true", "w=1,j=maybe",
+		"w=1,wtimeout=5", "w=1,fsync=true"} {
+		_, err = ParseWriteConcern(value)
+		ensure.NotNil(t, err, value)
+	}
+}
+
+func TestRecordedWriteConcern(t *testing.T) {
+	t.Parallel()
+
+	findAndModify := &Op{Type: Command, CommandDoc: bson.D{
+		{"findAndModify", "coll"},
+		{"writeConcern", bson.D{{"w", "majority"}, {"wtimeout", 1000}}},
+	}}
+	c, ok := recordedWriteConcern(findAndModify)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, c, WriteConcern{W: "majority", WTimeout: time.Second})
+
+	insert := &Op{Type: Insert, RecordedWriteConcern: bson.D{{"j", true}}}
+	c, ok = recordedWriteConcern(insert)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, c, WriteConcern{W: "1", J: true})
+
+	_, ok = recordedWriteConcern(&Op{Type: Insert})
+	ensure.False(t, ok)
+	_, ok = recordedWriteConcern(&Op{Type: Insert, RecordedWriteConcern: bson.D{{"w", -1}}})
+	ensure.False(t, ok)
+}
+
+func TestSetConcerns(t *testing.T) {
+	t.Parallel()
+
+	majority := WriteConcern{W: "majority"}
+	config := &ReplayConfig{
+		WriteConcern:            majority,
+		WriteConcernByNamespace: map[string]WriteConcern{"db.logs": Unacknowledged},
+		ReadConcern:             "majority",
+		ReadConcernByNamespace:  map[string]string{"db.logs": "local"},
+	}
+	recorded := bson.D{{"w", 1}}
+
+	op := &Op{Type: Insert, Database: "db", Collection: "users", RecordedWriteConcern: recorded}
+	config.setConcerns(op)
+	ensure.DeepEqual(t, op.WriteConcern, majority)
+	ensure.DeepEqual(t, op.ReadConcern, "")
+
+	op = &Op{Type: Remove, Database: "db", Collection: "logs"}
+	config.setConcerns(op)
+	ensure.DeepEqual(t, op.WriteConcern, Unacknowledged)
+
+	op = &Op{Type: Query, Database: "db", Collection: "logs"}
+	config.setConcerns(op)
+	ensure.DeepEqual(t, op.WriteConcern, WriteConcern{})
+	ensure.DeepEqual(t, op.ReadConcern, "local")
+	op.Collection = "users"
+	config.setConcerns(op)
+	ensure.DeepEqual(t, op.ReadConcern, "majority")
+
+	// the recorded write concern wins when it's honored
+	config.HonorRecordedWriteConcern = true
+	op = &Op{Type: Update, Database: "db", Collection: "logs", RecordedWriteConcern: recorded}
+	config.setConcerns(op)
+	ensure.DeepEqual(t, op.WriteConcern, WriteConcern{W: "1"})
+	op.RecordedWriteConcern = nil
+	config.setConcerns(op)
+	ensure.DeepEqual(t, op.WriteConcern, Unacknowledged)
+}
+
+func TestMgoSafe(t *testing.T) {
+	t.Parallel()
+
+	ensure.True(t, mgoSafe(Unacknowledged) == nil)
+	ensure.DeepEqual(t, mgoSafe(WriteConcern{W: "2", J: true}), &mgo.Safe{W: 2, J: true})
+	ensure.DeepEqual(t, mgoSafe(WriteConcern{W: "majority", WTimeout: time.Second}),
+		&mgo.Safe{WMode: "majority", WTimeout: 1000})
+}
@@ -0,0 +1,164 @@
+package flashback
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DispatchControl lets the pace of a running dispatcher be changed: it can be
+// paused, resumed, sped up, slowed down or stopped. It is safe for concurrent
+// use.
+type DispatchControl struct {
+	mutex   sync.Mutex
+	paused  bool
+	stopped bool
+	// only used by the time-based dispatcher
+	speedup float64
+	// only used by the best-effort dispatcher, in ops/sec. Zero means there
+	// is no limit.
+	rate float64
+	// closed, and replaced, every time anything changes
+	changed chan struct{}
+}
+
+func NewDispatchControl(speedup float64, rate float64) (*DispatchControl, error) {
+	c := &DispatchControl{changed: make(chan struct{})}
+	if err := c.SetSpeedup(speedup); err != nil {
+		return nil, err
+	}
+	if err := c.SetRate(rate); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// update applies a change and wakes up whoever waits for one
+func (c *DispatchControl) update(change func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	change()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed on the next change
+func (c *DispatchControl) Changed() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.changed
+}
+
+// Pause holds the dispatching of ops until Resume is called
+func (c *DispatchControl) Pause() {
+	c.update(func() { c.paused = true })
+}
+
+func (c *DispatchControl) Resume() {
+	c.update(func() { c.paused = false })
+}
+
+// Stop ends the dispatching for good. The ops that were already dispatched
+// are not affected, but workers may use Stopped to skip them.
+func (c *DispatchControl) Stop() {
+	c.update(func() { c.stopped = true })
+}
+
+func (c *DispatchControl) SetSpeedup(speedup float64) error {
+	if speedup <= 0 {
+		return errors.New("speedup must be a positive number")
+	}
+	c.update(func() { c.speedup = speedup })
+	return nil
+}
+
+func (c *DispatchControl) SetRate(rate float64) error {
+	if rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	c.update(func() { c.rate = rate })
+	return nil
+}
+
+func (c *DispatchControl) Paused() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.paused
+}
+
+func (c *DispatchControl) Stopped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stopped
+}
+
+func (c *DispatchControl) Speedup() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.speedup
+}
+
+func (c *DispatchControl) Rate() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.rate
+}
+
+// waitWhilePaused blocks until the dispatching is resumed or stopped. It
+// returns true if it is stopped.
+func (c *DispatchControl) waitWhilePaused() bool {
+	return c.holdOp(nil)
+}
+
+// holdOp blocks a worker that has an op to run until the dispatching is
+// resumed or stopped, or the worker is told to quit, so that the ops that are
+// already queued don't run while paused. It returns true if the op must be
+// dropped.
+func (c *DispatchControl) holdOp(quit <-chan struct{}) bool {
+	for {
+		c.mutex.Lock()
+		paused, stopped, changed := c.paused, c.stopped, c.changed
+		c.mutex.Unlock()
+		if stopped || !paused {
+			return stopped
+		}
+		select {
+		case <-changed:
+		case <-quit:
+			return true
+		}
+	}
+}
+
+// throttle blocks until the next op may be dispatched, honoring pauses and
+// the rate limit. last is when the previous op was dispatched. It returns
+// true if the dispatching is stopped.
+func (c *DispatchControl) throttle(last time.Time) bool {
+	for {
+		changed := c.Changed()
+		if c.waitWhilePaused() {
+			return true
+		}
+		rate := c.Rate()
+		if rate == 0 || last.IsZero() {
+			return false
+		}
+		wait := last.Add(time.Duration(float64(time.Second) / rate)).Sub(time.Now())
+		if wait <= 0 || c.sleep(wait, changed) {
+			return false
+		}
+	}
+}
+
+// sleep waits for d unless something changes in the meantime, as notified by
+// changed. It returns false if it was interrupted.
+func (c *DispatchControl) sleep(d time.Duration, changed <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-changed:
+		return false
+	}
+}
@@ -0,0 +1,140 @@
+package flashback
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestDispatchControlSettings(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewDispatchControl(0, 0)
+	ensure.NotNil(t, err)
+	_, err = NewDispatchControl(1, -1)
+	ensure.NotNil(t, err)
+
+	control, err := NewDispatchControl(2, 100)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, control.Speedup(), 2.0)
+	ensure.DeepEqual(t, control.Rate(), 100.0)
+
+	changed := control.Changed()
+	ensure.Nil(t, control.SetSpeedup(4))
+	<-changed
+	ensure.DeepEqual(t, control.Speedup(), 4.0)
+	ensure.NotNil(t, control.SetSpeedup(-1))
+	ensure.DeepEqual(t, control.Speedup(), 4.0)
+
+	control.Pause()
+	ensure.True(t, control.Paused())
+	control.Resume()
+	ensure.False(t, control.Paused())
+	ensure.False(t, control.waitWhilePaused())
+	control.Stop()
+	ensure.True(t, control.Stopped())
+	ensure.True(t, control.waitWhilePaused())
+}
+
+func TestHoldOp(t *testing.T) {
+	t.Parallel()
+
+	control, err := NewDispatchControl(1, 0)
+	ensure.Nil(t, err)
+	ensure.False(t, control.holdOp(nil))
+
+	// a worker holds its op until the replay is resumed
+	control.Pause()
+	held := make(chan bool)
+	go func() { held <- control.holdOp(nil) }()
+	select {
+	case <-held:
+		t.Fatal("the op ran while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	control.Resume()
+	ensure.False(t, <-held)
+
+	// or drops it when it quits
+	control.Pause()
+	quit := make(chan struct{})
+	go func() { held <- control.holdOp(quit) }()
+	close(quit)
+	ensure.True(t, <-held)
+}
+
+func TestBestEffortDispatcherControl(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	// paused before it starts, the dispatcher sends nothing until resumed
+	control, err := NewDispatchControl(1, 0)
+	ensure.Nil(t, err)
+	control.Pause()
+	opsChan := NewBestEffortOpsDispatcher(newSliceOpsReader(makeTimedOps(5, 0)), 5, logger, control)
+	select {
+	case <-opsChan:
+		t.Fatal("an op was dispatched while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	control.Resume()
+	ensure.DeepEqual(t, drain(opsChan), 5)
+
+	// stopping ends the dispatching
+	control, err = NewDispatchControl(1, 0)
+	ensure.Nil(t, err)
+	control.Pause()
+	opsChan = NewBestEffortOpsDispatcher(newSliceOpsReader(makeTimedOps(5, 0)), 5, logger, control)
+	control.Stop()
+	ensure.DeepEqual(t, drain(opsChan), 0)
+}
+
+func TestBestEffortDispatcherRate(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	control, err := NewDispatchControl(1, 100)
+	ensure.Nil(t, err)
+	start := time.Now()
+	opsChan := NewBestEffortOpsDispatcher(newSliceOpsReader(makeTimedOps(6, 0)), 6, logger, control)
+	ensure.DeepEqual(t, drain(opsChan), 6)
+	// 5 intervals of 10ms between the 6 ops
+	ensure.True(t, time.Now().Sub(start) >= 50*time.Millisecond)
+}
+
+func TestByTimeDispatcherControl(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	// an hour between ops; speeding up lets the replay finish right away
+	control, err := NewDispatchControl(1, 0)
+	ensure.Nil(t, err)
+	opsChan := NewByTimeOpsDispatcher(newSliceOpsReader(makeTimedOps(3, time.Hour)), 3, logger, 1, nil, control)
+	ensure.NotNil(t, <-opsChan)
+	ensure.Nil(t, control.SetSpeedup(1e9))
+	ensure.DeepEqual(t, drain(opsChan), 2)
+
+	// the trace clock stands still while paused, so ops are not late after
+	// resuming
+	schedule, err := NewReplaySchedule(0, LateOpContinue)
+	ensure.Nil(t, err)
+	control, err = NewDispatchControl(1, 0)
+	ensure.Nil(t, err)
+	opsChan = NewByTimeOpsDispatcher(newSliceOpsReader(makeTimedOps(2, 50*time.Millisecond)), 2, logger, 1,
+		schedule, control)
+	ensure.NotNil(t, <-opsChan)
+	control.Pause()
+	time.Sleep(100 * time.Millisecond)
+	control.Resume()
+	ensure.DeepEqual(t, drain(opsChan), 1)
+	ensure.True(t, schedule.MaxLag() < 50*time.Millisecond)
+
+	// stopping interrupts a long wait
+	control, err = NewDispatchControl(1, 0)
+	ensure.Nil(t, err)
+	opsChan = NewByTimeOpsDispatcher(newSliceOpsReader(makeTimedOps(3, time.Hour)), 3, logger, 1, nil, control)
+	ensure.NotNil(t, <-opsChan)
+	control.Stop()
+	ensure.DeepEqual(t, drain(opsChan), 0)
+}
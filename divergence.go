@@ -0,0 +1,195 @@
+package flashback
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Divergence is a collection whose data differs between the reference node
+// and a challenger once the replay is over
+type Divergence struct {
+	Node         string
+	Namespace    string
+	Hash         string
+	ExpectedHash string
+	// [Optional] A sample of the _ids of the documents that differ, or that
+	// are only on one of the nodes
+	SampleIds []interface{}
+}
+
+func (d Divergence) String() string {
+	hash := func(h string) string {
+		if h == "" {
+			return "missing"
+		}
+		return h
+	}
+	msg := fmt.Sprintf("[%s] %s diverged: hash %s, expected %s", d.Node, d.Namespace,
+		hash(d.Hash), hash(d.ExpectedHash))
+	if len(d.SampleIds) > 0 {
+		ids := make([]string, len(d.SampleIds))
+		for i, id := range d.SampleIds {
+			ids[i] = docString(id)
+		}
+		msg += ", differing _ids: " + strings.Join(ids, ", ")
+	}
+	return msg
+}
+
+// namespaceSet keeps track of the namespaces the ops touched
+type namespaceSet struct {
+	mutex      sync.Mutex
+	namespaces map[string]map[string]struct{}
+}
+
+func newNamespaceSet() *namespaceSet {
+	return &namespaceSet{namespaces: make(map[string]map[string]struct{})}
+}
+
+// merge adds the namespaces that a worker collected on its own, so that
+// workers only share the lock once
+func (s *namespaceSet) merge(other *namespaceSet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for database, collections := range other.namespaces {
+		for collection := range collections {
+			s.add(database, collection)
+		}
+	}
+}
+
+func (s *namespaceSet) add(database, collection string) {
+	if database == "" || collection == "" || collection == "$cmd" {
+		return
+	}
+	collections, ok := s.namespaces[database]
+	if !ok {
+		collections = make(map[string]struct{})
+		s.namespaces[database] = collections
+	}
+	collections[collection] = struct{}{}
+}
+
+// sorted returns the collections of each database, in a stable order
+func (s *namespaceSet) sorted() (databases []string, collections map[string][]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	collections = make(map[string][]string, len(s.namespaces))
+	for database, names := range s.namespaces {
+		databases = append(databases, database)
+		for name := range names {
+			collections[database] = append(collections[database], name)
+		}
+		sort.Strings(collections[database])
+	}
+	sort.Strings(databases)
+	return databases, collections
+}
+
+// findDivergences hashes every touched collection on every node, and reports
+// the ones whose hash differs from the one on the reference node, the first
+// of the backends. With maxSampleIds, the documents of diverged collections
+// are compared one by one to sample the _ids that differ.
+func findDivergences(names []string, backends []ExecutorBackend, namespaces *namespaceSet,
+	maxSampleIds int) ([]Divergence, error) {
+
+	databases, collections := namespaces.sorted()
+	var divergences []Divergence
+	for _, database := range databases {
+		hashes := make([]map[string]string, len(backends))
+		errs := make([]error, len(backends))
+		var wg sync.WaitGroup
+		for i, backend := range backends {
+			wg.Add(1)
+			go func(i int, backend ExecutorBackend) {
+				defer wg.Done()
+				hashes[i], errs[i] = backend.DBHash(database, collections[database])
+			}(i, backend)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				return divergences, fmt.Errorf("cannot hash database %s on node %s: %v", database, names[i], err)
+			}
+		}
+
+		for _, collection := range collections[database] {
+			for i := 1; i < len(backends); i++ {
+				if hashes[i][collection] == hashes[0][collection] {
+					continue
+				}
+				divergence := Divergence{
+					Node:         names[i],
+					Namespace:    database + "." + collection,
+					Hash:         hashes[i][collection],
+					ExpectedHash: hashes[0][collection],
+				}
+				if maxSampleIds > 0 {
+					ids, err := sampleDifferingIds(backends[0], backends[i], database, collection, maxSampleIds)
+					if err != nil {
+						return divergences, fmt.Errorf("cannot compare the documents of %s on node %s: %v",
+							divergence.Namespace, names[i], err)
+					}
+					divergence.SampleIds = ids
+				}
+				divergences = append(divergences, divergence)
+			}
+		}
+	}
+	return divergences, nil
+}
+
+// sampleDifferingIds compares the documents of a collection on two nodes. The
+// reference documents are kept as a checksum per _id, then the challenger's
+// documents are checked off against them. Like dbHash, the checksum depends on
+// the order of the fields, down to the embedded documents.
+func sampleDifferingIds(reference, challenger ExecutorBackend, database, collection string,
+	maxSampleIds int) ([]interface{}, error) {
+
+	type checksum struct {
+		id  interface{}
+		sum [md5.Size]byte
+	}
+	expected := make(map[string]checksum)
+	err := reference.ScanCollection(database, collection, func(doc bson.D) bool {
+		id, _ := GetElem(doc, "_id")
+		expected[docString(id)] = checksum{id, md5.Sum([]byte(docString(doc)))}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []interface{}
+	err = challenger.ScanCollection(database, collection, func(doc bson.D) bool {
+		id, _ := GetElem(doc, "_id")
+		key := docString(id)
+		if want, ok := expected[key]; !ok || want.sum != md5.Sum([]byte(docString(doc))) {
+			ids = append(ids, id)
+		}
+		delete(expected, key)
+		return len(ids) < maxSampleIds
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// what is left is missing on the challenger
+	missing := make([]string, 0, len(expected))
+	for id := range expected {
+		missing = append(missing, id)
+	}
+	sort.Strings(missing)
+	for _, id := range missing {
+		if len(ids) >= maxSampleIds {
+			break
+		}
+		ids = append(ids, expected[id].id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,103 @@
+package flashback
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeDataBackend serves the hashes and documents of a node's collections,
+// keyed by namespace. The other methods are left unimplemented.
+type fakeDataBackend struct {
+	ExecutorBackend
+	hashes map[string]string
+	docs   map[string][]bson.D
+}
+
+func (b *fakeDataBackend) DBHash(database string, collections []string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, collection := range collections {
+		if hash, ok := b.hashes[database+"."+collection]; ok {
+			hashes[collection] = hash
+		}
+	}
+	return hashes, nil
+}
+
+func (b *fakeDataBackend) ScanCollection(database, collection string, fn func(doc bson.D) bool) error {
+	for _, doc := range b.docs[database+"."+collection] {
+		if !fn(doc) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestNamespaceSet(t *testing.T) {
+	t.Parallel()
+
+	local := newNamespaceSet()
+	local.add("db", "b")
+	local.add("db", "a")
+	local.add("db", "$cmd")
+	local.add("", "a")
+	set := newNamespaceSet()
+	set.add("other", "c")
+	set.add("db", "a")
+	set.merge(local)
+
+	databases, collections := set.sorted()
+	ensure.DeepEqual(t, databases, []string{"db", "other"})
+	ensure.DeepEqual(t, collections["db"], []string{"a", "b"})
+	ensure.DeepEqual(t, collections["other"], []string{"c"})
+}
+
+func TestFindDivergences(t *testing.T) {
+	t.Parallel()
+
+	reference := &fakeDataBackend{
+		hashes: map[string]string{"db.same": "1", "db.changed": "2", "db.dropped": "3"},
+		docs: map[string][]bson.D{
+			"db.changed": {
+				{{"_id", 1}, {"a", 1}}, {{"_id", 2}, {"a", 2}}, {{"_id", 3}, {"a", 3}}, {{"_id", 4}, {"a", 4}},
+				{{"_id", 6}, {"a", 6}, {"b", bson.D{{"c", 6}, {"d", 6}}}},
+			},
+		},
+	}
+	challenger := &fakeDataBackend{
+		hashes: map[string]string{"db.same": "1", "db.changed": "5"},
+		docs: map[string][]bson.D{
+			// 2 differs, 3 is missing, 5 is extra, and the embedded fields of 6
+			// are in another order
+			"db.changed": {
+				{{"_id", 1}, {"a", 1}}, {{"_id", int64(2)}, {"a", 0}}, {{"_id", 4}, {"a", 4}}, {{"_id", 5}, {"a", 5}},
+				{{"_id", 6}, {"a", 6}, {"b", bson.D{{"d", 6}, {"c", 6}}}},
+			},
+		},
+	}
+	namespaces := newNamespaceSet()
+	for _, collection := range []string{"same", "changed", "dropped", "never_created"} {
+		namespaces.add("db", collection)
+	}
+	names := []string{"default", "challenger"}
+	backends := []ExecutorBackend{reference, challenger}
+
+	divergences, err := findDivergences(names, backends, namespaces, 0)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, divergences, []Divergence{
+		{Node: "challenger", Namespace: "db.changed", Hash: "5", ExpectedHash: "2"},
+		{Node: "challenger", Namespace: "db.dropped", Hash: "", ExpectedHash: "3"},
+	})
+	ensure.DeepEqual(t, divergences[1].String(), "[challenger] db.dropped diverged: hash missing, expected 3")
+
+	divergences, err = findDivergences(names, backends, namespaces, 10)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, divergences[0].SampleIds, []interface{}{int64(2), 5, 6, 3})
+	ensure.DeepEqual(t, divergences[0].String(),
+		"[challenger] db.changed diverged: hash 5, expected 2, differing _ids: 2, 5, 6, 3")
+
+	divergences, err = findDivergences(names, backends, namespaces, 1)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, divergences[0].SampleIds, []interface{}{int64(2)})
+}
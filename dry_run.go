@@ -0,0 +1,203 @@
+package flashback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DryRunBackend goes through the arguments of the ops the same way the other
+// backends do, without connecting to anything
+type DryRunBackend struct{}
+
+func NewDryRunBackend() *DryRunBackend {
+	return &DryRunBackend{}
+}
+
+func checkNamespace(op *Op) error {
+	if op.Database == "" || op.Collection == "" {
+		return fmt.Errorf("bad namespace %q", op.Ns)
+	}
+	return nil
+}
+
+func (b *DryRunBackend) Query(ctx context.Context, op *Op) ([]Document, error) {
+	if err := checkNamespace(op); err != nil {
+		return nil, err
+	}
+	if query, ok := GetElem(op.QueryDoc, "$query"); ok {
+		if _, ok := query.(bson.D); !ok {
+			return nil, errors.New("bad $query document in query operation")
+		}
+	}
+	return []Document{}, nil
+}
+
+func (b *DryRunBackend) Insert(ctx context.Context, op *Op) error {
+	if err := checkNamespace(op); err != nil {
+		return err
+	}
+	if len(op.InsertDoc) == 0 {
+		return errors.New("missing document in insert operation")
+	}
+	return nil
+}
+
+func (b *DryRunBackend) Update(ctx context.Context, op *Op) (*WriteOutcome, error) {
+	return &WriteOutcome{}, checkNamespace(op)
+}
+
+func (b *DryRunBackend) Remove(ctx context.Context, op *Op) (*WriteOutcome, error) {
+	return &WriteOutcome{}, checkNamespace(op)
+}
+
+func (b *DryRunBackend) Count(ctx context.Context, op *Op) (int, error) {
+	if err := checkNamespace(op); err != nil {
+		return 0, err
+	}
+	_, err := countQuery(op)
+	return 0, err
+}
+
+func (b *DryRunBackend) FindAndModify(ctx context.Context, op *Op) (Document, error) {
+	if err := checkNamespace(op); err != nil {
+		return nil, err
+	}
+	if _, _, err := findAndModifyArgs(op); err != nil {
+		return nil, err
+	}
+	return Document{}, nil
+}
+
+func (b *DryRunBackend) Explain(op *Op) (Document, error) {
+	if _, err := explainCommand(op); err != nil {
+		return nil, err
+	}
+	return Document{}, nil
+}
+
+func (b *DryRunBackend) DBHash(database string, collections []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (b *DryRunBackend) ScanCollection(database, collection string, fn func(doc bson.D) bool) error {
+	return nil
+}
+
+// Classify only ever sees invalid ops
+func (b *DryRunBackend) Classify(err error) (ErrorCategory, int) {
+	return OtherError, 0
+}
+
+func (b *DryRunBackend) Refresh() {
+}
+
+func (b *DryRunBackend) Close() {
+}
+
+// What a dry run makes of an op
+type DryRunOutcome string
+
+const (
+	// The op would run
+	DryRunExecutable DryRunOutcome = "executable"
+	// The op would be left out, as its type or command is not supported
+	DryRunSkipped DryRunOutcome = "skipped"
+	// The op would fail before reaching the database
+	DryRunInvalid DryRunOutcome = "invalid"
+)
+
+// DryRunCount is the number of ops of a type on a namespace that got the same
+// outcome
+type DryRunCount struct {
+	Outcome   DryRunOutcome
+	Type      OpType
+	Namespace string
+	Count     int
+	// Why the first of these ops was skipped, or is invalid
+	Reason string
+}
+
+// DryRunReport breaks the ops of a dry run down by outcome, type and namespace
+type DryRunReport struct {
+	Totals map[DryRunOutcome]int
+	// Sorted by outcome, type and namespace
+	Counts []DryRunCount
+}
+
+type dryRunCounts []DryRunCount
+
+func (c dryRunCounts) Len() int      { return len(c) }
+func (c dryRunCounts) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c dryRunCounts) Less(i, j int) bool {
+	if c[i].Outcome != c[j].Outcome {
+		return c[i].Outcome < c[j].Outcome
+	}
+	if c[i].Type != c[j].Type {
+		return c[i].Type < c[j].Type
+	}
+	return c[i].Namespace < c[j].Namespace
+}
+
+// DryRunOps runs up to maxOps ops through an OpsExecutor on a DryRunBackend,
+// and tells which ones would be executed, skipped or fail
+func DryRunOps(reader OpsReader, maxOps int, logger *Logger) (*DryRunReport, error) {
+	exec := NewBackendOpsExecutor(NewDryRunBackend(), nil, logger)
+	report := &DryRunReport{Totals: make(map[DryRunOutcome]int)}
+	counts := make(map[DryRunCount]*DryRunCount)
+
+	for ops := 0; ops < maxOps; ops++ {
+		op := reader.Next()
+		if op == nil {
+			break
+		}
+
+		outcome, reason := DryRunExecutable, ""
+		if op.Type == GetMore {
+			outcome, reason = DryRunSkipped, "getmore ops are not replayed"
+		} else if err := exec.Execute(op); err == NotSupported {
+			outcome, reason = DryRunSkipped, err.Error()
+			if op.Type == Command && len(op.CommandDoc) > 0 {
+				reason = fmt.Sprintf("command %q not supported", op.CommandDoc[0].Name)
+			}
+		} else if err != nil {
+			outcome, reason = DryRunInvalid, err.Error()
+		}
+
+		// commands were canonicalized in place, and refer to their collection
+		key := DryRunCount{Outcome: outcome, Type: op.Type, Namespace: op.Database + "." + op.Collection}
+		count, ok := counts[key]
+		if !ok {
+			count = &DryRunCount{Outcome: key.Outcome, Type: key.Type, Namespace: key.Namespace, Reason: reason}
+			counts[key] = count
+		}
+		count.Count++
+		report.Totals[outcome]++
+	}
+
+	for _, count := range counts {
+		report.Counts = append(report.Counts, *count)
+	}
+	sort.Sort(dryRunCounts(report.Counts))
+	return report, reader.Err()
+}
+
+// Print writes the report as a table
+func (r *DryRunReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s: %d, %s: %d, %s: %d\n",
+		DryRunExecutable, r.Totals[DryRunExecutable],
+		DryRunSkipped, r.Totals[DryRunSkipped],
+		DryRunInvalid, r.Totals[DryRunInvalid])
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "OUTCOME\tTYPE\tNAMESPACE\tOPS\tREASON")
+	for _, count := range r.Counts {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\n",
+			count.Outcome, count.Type, count.Namespace, count.Count, count.Reason)
+	}
+	table.Flush()
+}
@@ -0,0 +1,57 @@
+package flashback
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDryRunOps(t *testing.T) {
+	t.Parallel()
+
+	ops := []*Op{
+		{Ns: "db.coll", Type: Query, Database: "db", Collection: "coll", QueryDoc: bson.D{{"a", 1}}},
+		{Ns: "db.coll", Type: Query, Database: "db", Collection: "coll", QueryDoc: bson.D{{"$query", 1}}},
+		{Ns: "db.coll", Type: Insert, Database: "db", Collection: "coll", InsertDoc: bson.D{{"a", 1}}},
+		{Ns: "db.coll", Type: Insert, Database: "db", Collection: "coll", InsertDoc: bson.D{{"a", 2}}},
+		{Ns: "db.other", Type: Update, Database: "db", Collection: "other"},
+		{Ns: "db.coll", Type: GetMore, Database: "db", Collection: "coll"},
+		{Ns: "db", Type: Remove, Database: "db"},
+		{Ns: "db.$cmd", Type: Command, Database: "db", Collection: "$cmd",
+			CommandDoc: bson.D{{"count", "coll"}}},
+		{Ns: "db.$cmd", Type: Command, Database: "db", Collection: "$cmd",
+			CommandDoc: bson.D{{"findandmodify", "coll"}, {"query", bson.D{}}}},
+		{Ns: "db.$cmd", Type: Command, Database: "db", Collection: "$cmd",
+			CommandDoc: bson.D{{"isMaster", 1}}},
+		{Ns: "db.$cmd", Type: Command, Database: "db", Collection: "$cmd"},
+		{Ns: "db.coll", Type: "killcursors", Database: "db", Collection: "coll"},
+		// beyond maxOps
+		{Ns: "db.coll", Type: Insert, Database: "db", Collection: "coll", InsertDoc: bson.D{{"a", 3}}},
+	}
+	logger, _ := NewLogger("", "")
+	report, err := DryRunOps(newSliceOpsReader(ops), len(ops)-1, logger)
+	ensure.Nil(t, err)
+
+	ensure.DeepEqual(t, report.Totals, map[DryRunOutcome]int{
+		DryRunExecutable: 5, DryRunSkipped: 3, DryRunInvalid: 4})
+	ensure.DeepEqual(t, report.Counts, []DryRunCount{
+		{DryRunExecutable, Count, "db.coll", 1, ""},
+		{DryRunExecutable, Insert, "db.coll", 2, ""},
+		{DryRunExecutable, Query, "db.coll", 1, ""},
+		{DryRunExecutable, Update, "db.other", 1, ""},
+		{DryRunInvalid, Command, "db.$cmd", 1, "empty command document"},
+		{DryRunInvalid, FindAndModify, "db.coll", 1, "missing update document in findAndModify operation"},
+		{DryRunInvalid, Query, "db.coll", 1, "bad $query document in query operation"},
+		{DryRunInvalid, Remove, "db.", 1, `bad namespace "db"`},
+		{DryRunSkipped, Command, "db.$cmd", 1, `command "isMaster" not supported`},
+		{DryRunSkipped, GetMore, "db.coll", 1, "getmore ops are not replayed"},
+		{DryRunSkipped, "killcursors", "db.coll", 1, "op type not supported"},
+	})
+
+	var out bytes.Buffer
+	report.Print(&out)
+	ensure.StringContains(t, out.String(), "executable: 5, skipped: 3, invalid: 4\n")
+	ensure.StringContains(t, out.String(), "command.findandmodify")
+}
@@ -0,0 +1,331 @@
+package flashback
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// QueryPlan is what explain says about the way a node runs a query shape
+type QueryPlan struct {
+	// The stages of the winning plan, from the root, i.e.
+	// "FETCH > IXSCAN(a_1)"
+	WinningPlan string
+	// The indexes the winning plan uses, comma separated
+	Index        string
+	DocsExamined int
+	CollScan     bool
+}
+
+// ShapePlans are the plans of every node for a query shape
+type ShapePlans struct {
+	Shape     string
+	Type      OpType
+	Namespace string
+	// One per node, in the order of the nodes
+	Nodes  []string
+	Plans  []QueryPlan
+	Errors []error
+	// The plan of a challenger differs from the one of the reference node,
+	// or only one of them failed to explain the shape
+	Differs bool
+}
+
+// explainCommand wraps the command that op would run in an explain command
+func explainCommand(op *Op) (bson.D, error) {
+	var cmd bson.D
+	switch op.Type {
+	case Query:
+		filter := op.QueryDoc
+		cmd = bson.D{{"find", op.Collection}}
+		if query, ok := GetElem(op.QueryDoc, "$query"); ok {
+			filter, _ = query.(bson.D)
+			if sort, ok := GetElem(op.QueryDoc, "$orderby"); ok {
+				cmd = append(cmd, bson.DocElem{"sort", sort})
+			}
+			if hint, ok := GetElem(op.QueryDoc, "$hint"); ok {
+				cmd = append(cmd, bson.DocElem{"hint", hint})
+			}
+		}
+		if filter == nil {
+			filter = bson.D{}
+		}
+		cmd = append(cmd, bson.DocElem{"filter", filter})
+		if op.NToSkip != 0 {
+			cmd = append(cmd, bson.DocElem{"skip", op.NToSkip})
+		}
+		if op.NToReturn != 0 {
+			cmd = append(cmd, bson.DocElem{"limit", op.NToReturn})
+		}
+	case Count:
+		query, _ := GetElem(op.CommandDoc, "query")
+		if query == nil {
+			query = bson.D{}
+		}
+		cmd = bson.D{{"count", op.Collection}, {"query", query}}
+	case Update:
+		cmd = bson.D{{"update", op.Collection},
+			{"updates", []bson.D{{{"q", op.QueryDoc}, {"u", op.UpdateDoc}}}}}
+	case Remove:
+		cmd = bson.D{{"delete", op.Collection},
+			{"deletes", []bson.D{{{"q", op.QueryDoc}, {"limit", 1}}}}}
+	case FindAndModify:
+		query, update, err := findAndModifyArgs(op)
+		if err != nil {
+			return nil, err
+		}
+		cmd = bson.D{{"findAndModify", op.Collection}, {"query", query}, {"update", update}}
+	default:
+		return nil, NotSupported
+	}
+	// executionStats doesn't apply the writes
+	return bson.D{{"explain", cmd}, {"verbosity", "executionStats"}}, nil
+}
+
+// queryShape is the filter and the sort of an op, without their values, so
+// that the ops that are planned the same way share a shape
+func queryShape(op *Op) (string, bool) {
+	var filter, sort interface{}
+	switch op.Type {
+	case Query:
+		filter = op.QueryDoc
+		if query, ok := GetElem(op.QueryDoc, "$query"); ok {
+			filter = query
+			sort, _ = GetElem(op.QueryDoc, "$orderby")
+		}
+	case Update, Remove:
+		filter = op.QueryDoc
+	case Count, FindAndModify:
+		filter, _ = GetElem(op.CommandDoc, "query")
+	default:
+		return "", false
+	}
+	shape := shapeOf(filter)
+	if sort != nil {
+		shape += " sort " + docString(sort)
+	}
+	return shape, true
+}
+
+// shapeOf replaces the values of a document with "?", and keeps its fields
+// and operators
+func shapeOf(value interface{}) string {
+	if m, ok := asMap(value); ok {
+		value = mapToD(m)
+	}
+	switch value := value.(type) {
+	case nil:
+		return "{}"
+	case bson.D:
+		fields := make([]string, len(value))
+		for i, elem := range value {
+			fields[i] = elem.Name + ": " + shapeOf(elem.Value)
+		}
+		sort.Strings(fields)
+		return "{" + strings.Join(fields, ", ") + "}"
+	case []interface{}:
+		// the clauses of $and, $or and $nor are shaped one by one
+		elems := make([]string, len(value))
+		for i, elem := range value {
+			if _, ok := elem.(bson.D); !ok {
+				if _, ok := asMap(elem); !ok {
+					return "?"
+				}
+			}
+			elems[i] = shapeOf(elem)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	}
+	return "?"
+}
+
+func mapToD(m map[string]interface{}) bson.D {
+	doc := make(bson.D, 0, len(m))
+	for k, v := range m {
+		doc = append(doc, bson.DocElem{k, v})
+	}
+	return doc
+}
+
+// parsePlan extracts the winning plan out of the result of explain
+func parsePlan(explain Document) QueryPlan {
+	plan := QueryPlan{}
+	if planner, ok := asMap(explain["queryPlanner"]); ok {
+		var stages, indexes []string
+		walkPlan(planner["winningPlan"], &stages, &indexes, &plan.CollScan)
+		plan.WinningPlan = strings.Join(stages, " > ")
+		plan.Index = strings.Join(indexes, ",")
+	}
+	if stats, ok := asMap(explain["executionStats"]); ok {
+		plan.DocsExamined, _ = safeGetInt(stats["totalDocsExamined"])
+	}
+	return plan
+}
+
+// walkPlan goes down the stages of a plan, from the root
+func walkPlan(value interface{}, stages *[]string, indexes *[]string, collScan *bool) {
+	stage, ok := asMap(value)
+	if !ok {
+		return
+	}
+	// the plans of newer servers are nested, and so are the ones of shards
+	if queryPlan, ok := stage["queryPlan"]; ok {
+		walkPlan(queryPlan, stages, indexes, collScan)
+		return
+	}
+	if name, ok := stage["stage"].(string); ok {
+		if index, ok := stage["indexName"].(string); ok {
+			*stages = append(*stages, name+"("+index+")")
+			*indexes = appendUnique(*indexes, index)
+		} else {
+			*stages = append(*stages, name)
+		}
+		if name == "COLLSCAN" {
+			*collScan = true
+		}
+	}
+	walkPlan(stage["inputStage"], stages, indexes, collScan)
+	walkPlan(stage["winningPlan"], stages, indexes, collScan)
+	for _, key := range []string{"inputStages", "shards"} {
+		if inputs, ok := stage[key].([]interface{}); ok {
+			for _, input := range inputs {
+				walkPlan(input, stages, indexes, collScan)
+			}
+		}
+	}
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// shapeSet keeps the first op of every query shape
+type shapeSet struct {
+	mutex  sync.Mutex
+	shapes map[string]*Op
+}
+
+func newShapeSet() *shapeSet {
+	return &shapeSet{shapes: make(map[string]*Op)}
+}
+
+func shapeKey(op *Op, shape string) string {
+	return fmt.Sprintf("%s %s.%s %s", op.Type, op.Database, op.Collection, shape)
+}
+
+func (s *shapeSet) add(op *Op) {
+	shape, ok := queryShape(op)
+	if !ok {
+		return
+	}
+	key := shapeKey(op, shape)
+	if _, ok := s.shapes[key]; !ok {
+		copied := *op
+		s.shapes[key] = &copied
+	}
+}
+
+// merge adds the shapes that a worker collected on its own, so that workers
+// only share the lock once
+func (s *shapeSet) merge(other *shapeSet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, op := range other.shapes {
+		if _, ok := s.shapes[key]; !ok {
+			s.shapes[key] = op
+		}
+	}
+}
+
+// explainShapes runs explain for every shape on every node, the first of the
+// backends being the reference one
+func explainShapes(names []string, backends []ExecutorBackend, shapes *shapeSet) []ShapePlans {
+	shapes.mutex.Lock()
+	keys := make([]string, 0, len(shapes.shapes))
+	for key := range shapes.shapes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ops := make([]*Op, len(keys))
+	for i, key := range keys {
+		ops[i] = shapes.shapes[key]
+	}
+	shapes.mutex.Unlock()
+
+	results := make([]ShapePlans, len(ops))
+	for i, op := range ops {
+		shape, _ := queryShape(op)
+		result := ShapePlans{
+			Shape:     shape,
+			Type:      op.Type,
+			Namespace: op.Database + "." + op.Collection,
+			Nodes:     names,
+			Plans:     make([]QueryPlan, len(backends)),
+			Errors:    make([]error, len(backends)),
+		}
+		var wg sync.WaitGroup
+		for j, backend := range backends {
+			wg.Add(1)
+			go func(j int, backend ExecutorBackend) {
+				defer wg.Done()
+				explain, err := backend.Explain(op)
+				if err == nil {
+					result.Plans[j] = parsePlan(explain)
+				}
+				result.Errors[j] = err
+			}(j, backend)
+		}
+		wg.Wait()
+		for j := 1; j < len(backends); j++ {
+			// A shape that only one of the nodes can explain, e.g. because
+			// of a hinted index that is missing on it, differs as well
+			if (result.Errors[0] == nil) != (result.Errors[j] == nil) {
+				result.Differs = true
+			} else if result.Errors[0] == nil &&
+				(result.Plans[j].WinningPlan != result.Plans[0].WinningPlan ||
+					result.Plans[j].CollScan != result.Plans[0].CollScan) {
+				result.Differs = true
+			}
+		}
+		results[i] = result
+	}
+	return results
+}
+
+// writePlans writes the plans of every shape, the ones that differ first
+func writePlans(w io.Writer, plans []ShapePlans) {
+	for _, differs := range []bool{true, false} {
+		for _, shape := range plans {
+			if shape.Differs != differs {
+				continue
+			}
+			flag := ""
+			if shape.Differs {
+				flag = " [PLAN DIFFERS]"
+			}
+			fmt.Fprintf(w, "%s %s %s%s\n", shape.Type, shape.Namespace, shape.Shape, flag)
+			for i, node := range shape.Nodes {
+				if shape.Errors[i] != nil {
+					fmt.Fprintf(w, "    [%s] error: %v\n", node, shape.Errors[i])
+					continue
+				}
+				plan := shape.Plans[i]
+				index := plan.Index
+				if index == "" {
+					index = "none"
+				}
+				fmt.Fprintf(w, "    [%s] plan: %s, index: %s, docs examined: %d, collscan: %t\n",
+					node, plan.WinningPlan, index, plan.DocsExamined, plan.CollScan)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package flashback
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeExplainBackend explains every op with the same result
+type fakeExplainBackend struct {
+	ExecutorBackend
+	explain Document
+	err     error
+}
+
+func (b *fakeExplainBackend) Explain(op *Op) (Document, error) {
+	return b.explain, b.err
+}
+
+func TestQueryShape(t *testing.T) {
+	t.Parallel()
+
+	shape := func(op *Op) string {
+		shape, ok := queryShape(op)
+		ensure.True(t, ok)
+		return shape
+	}
+	ensure.DeepEqual(t, shape(&Op{Type: Query, QueryDoc: bson.D{{"b", 1}, {"a", bson.D{{"$gt", 5}}}}}),
+		"{a: {$gt: ?}, b: ?}")
+	ensure.DeepEqual(t, shape(&Op{Type: Query, QueryDoc: bson.D{{"a", 2}, {"b", bson.M{"$gt": 3}}}}),
+		shape(&Op{Type: Query, QueryDoc: bson.D{{"b", bson.D{{"$gt", 1}}}, {"a", 1}}}))
+	ensure.DeepEqual(t, shape(&Op{Type: Query, QueryDoc: bson.D{
+		{"$query", bson.D{{"$or", []interface{}{bson.D{{"a", 1}}, bson.M{"b": 1}}}, {"c", bson.D{{"$in", []interface{}{1, 2}}}}}},
+		{"$orderby", bson.D{{"a", -1}}},
+	}}), "{$or: [{a: ?}, {b: ?}], c: {$in: ?}} sort {a: -1}")
+	ensure.DeepEqual(t, shape(&Op{Type: Update}), "{}")
+	ensure.DeepEqual(t, shape(&Op{Type: FindAndModify, CommandDoc: bson.D{{"findandmodify", "c"}, {"query", bson.D{{"a", 1}}}}}),
+		"{a: ?}")
+
+	_, ok := queryShape(&Op{Type: Insert})
+	ensure.False(t, ok)
+}
+
+func TestExplainCommand(t *testing.T) {
+	t.Parallel()
+
+	cmd, err := explainCommand(&Op{Type: Query, Collection: "coll", NToReturn: 10, QueryDoc: bson.D{
+		{"$query", bson.D{{"a", 1}}},
+		{"$orderby", bson.D{{"a", -1}}},
+	}})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, cmd, bson.D{
+		{"explain", bson.D{{"find", "coll"}, {"sort", bson.D{{"a", -1}}}, {"filter", bson.D{{"a", 1}}}, {"limit", int64(10)}}},
+		{"verbosity", "executionStats"},
+	})
+
+	cmd, err = explainCommand(&Op{Type: Count, Collection: "coll", CommandDoc: bson.D{{"count", "coll"}}})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, cmd[0].Value, bson.D{{"count", "coll"}, {"query", bson.D{}}})
+
+	_, err = explainCommand(&Op{Type: FindAndModify, CommandDoc: bson.D{{"findandmodify", "coll"}}})
+	ensure.NotNil(t, err)
+	_, err = explainCommand(&Op{Type: Insert})
+	ensure.DeepEqual(t, err, NotSupported)
+}
+
+func TestParsePlan(t *testing.T) {
+	t.Parallel()
+
+	plan := parsePlan(Document{
+		"queryPlanner": bson.M{"winningPlan": bson.M{
+			"stage": "FETCH",
+			"inputStage": bson.M{
+				"stage":      "IXSCAN",
+				"indexName":  "a_1",
+				"keyPattern": bson.M{"a": 1},
+			},
+		}},
+		"executionStats": bson.M{"totalDocsExamined": int32(12)},
+	})
+	ensure.DeepEqual(t, plan, QueryPlan{WinningPlan: "FETCH > IXSCAN(a_1)", Index: "a_1", DocsExamined: 12})
+
+	// newer servers nest the plan
+	plan = parsePlan(Document{
+		"queryPlanner":   bson.M{"winningPlan": bson.M{"queryPlan": bson.M{"stage": "COLLSCAN"}}},
+		"executionStats": bson.M{"totalDocsExamined": int64(1000)},
+	})
+	ensure.DeepEqual(t, plan, QueryPlan{WinningPlan: "COLLSCAN", DocsExamined: 1000, CollScan: true})
+
+	plan = parsePlan(Document{"queryPlanner": bson.M{"winningPlan": bson.M{
+		"stage": "SHARD_MERGE",
+		"shards": []interface{}{
+			bson.M{"winningPlan": bson.M{"stage": "IXSCAN", "indexName": "a_1"}},
+			bson.M{"winningPlan": bson.M{"stage": "IXSCAN", "indexName": "a_1"}},
+		},
+	}}})
+	ensure.DeepEqual(t, plan.WinningPlan, "SHARD_MERGE > IXSCAN(a_1) > IXSCAN(a_1)")
+	ensure.DeepEqual(t, plan.Index, "a_1")
+}
+
+func TestExplainShapes(t *testing.T) {
+	t.Parallel()
+
+	indexed := Document{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "IXSCAN", "indexName": "a_1"}}}
+	scanned := Document{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "COLLSCAN"}}}
+	shapes := newShapeSet()
+	local := newShapeSet()
+	local.add(&Op{Type: Query, Database: "db", Collection: "coll", QueryDoc: bson.D{{"a", 1}}})
+	local.add(&Op{Type: Query, Database: "db", Collection: "coll", QueryDoc: bson.D{{"a", 2}}})
+	local.add(&Op{Type: Insert, Database: "db", Collection: "coll"})
+	shapes.merge(local)
+	ensure.DeepEqual(t, len(shapes.shapes), 1)
+
+	names := []string{"default", "challenger", "broken"}
+	backends := []ExecutorBackend{
+		&fakeExplainBackend{explain: indexed},
+		&fakeExplainBackend{explain: scanned},
+		&fakeExplainBackend{err: errors.New("unreachable")},
+	}
+	plans := explainShapes(names, backends, shapes)
+	ensure.DeepEqual(t, len(plans), 1)
+	ensure.True(t, plans[0].Differs)
+	ensure.DeepEqual(t, plans[0].Namespace, "db.coll")
+	ensure.DeepEqual(t, plans[0].Shape, "{a: ?}")
+	ensure.DeepEqual(t, plans[0].Plans[1], QueryPlan{WinningPlan: "COLLSCAN", CollScan: true})
+
+	var out bytes.Buffer
+	writePlans(&out, plans)
+	ensure.DeepEqual(t, out.String(), "query db.coll {a: ?} [PLAN DIFFERS]\n"+
+		"    [default] plan: IXSCAN(a_1), index: a_1, docs examined: 0, collscan: false\n"+
+		"    [challenger] plan: COLLSCAN, index: none, docs examined: 0, collscan: true\n"+
+		"    [broken] error: unreachable\n")
+
+	backends[1] = &fakeExplainBackend{explain: indexed}
+	plans = explainShapes(names, backends, shapes)
+	ensure.True(t, plans[0].Differs)
+
+	backends[2] = &fakeExplainBackend{explain: indexed}
+	plans = explainShapes(names, backends, shapes)
+	ensure.False(t, plans[0].Differs)
+
+	// Both nodes failing to explain the shape isn't a difference
+	names = []string{"default", "challenger"}
+	backends = []ExecutorBackend{
+		&fakeExplainBackend{err: errors.New("unreachable")},
+		&fakeExplainBackend{err: errors.New("unreachable")},
+	}
+	plans = explainShapes(names, backends, shapes)
+	ensure.False(t, plans[0].Differs)
+}
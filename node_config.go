@@ -0,0 +1,155 @@
+package flashback
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NodeConfig describes a database the ops are replayed against
+type NodeConfig struct {
+	// Shows up in the logs and in the keys of Replayer.Status
+	Name string
+	// mongodb://[<user>:<password>@]<host>[:<port>]. Defaults to
+	// mongodb://localhost:27017
+	Url string
+	// [Optional] File that stores the stats at each report interval
+	StatsFilename string
+	// [Optional] Driver the ops are executed with, MgoDriver or
+	// MongoGoDriver. Defaults to MgoDriver.
+	Driver string
+	// [Optional] Defaults to the replay's SocketTimeout
+	SocketTimeout time.Duration
+
+	// [Optional] Credentials, used instead of the ones in Url
+	Username      string
+	Password      string
+	AuthSource    string
+	AuthMechanism string
+
+	// [Optional] Session options. Direct talks to the given host only, even
+	// if it's a replica set member. PoolLimit caps the number of connections.
+	Direct         bool
+	PoolLimit      int
+	ConnectTimeout time.Duration
+}
+
+var nodeSettings = []string{
+	"name", "url", "stats_filename", "driver", "socket_timeout", "username", "password", "auth_source",
+	"auth_mechanism", "direct", "pool_limit", "connect_timeout",
+}
+
+func isNodeSetting(key string) bool {
+	for _, setting := range nodeSettings {
+		if key == setting {
+			return true
+		}
+	}
+	return false
+}
+
+// set assigns one of the settings, named as in node config files
+func (n *NodeConfig) set(key string, value string) error {
+	var err error
+	switch key {
+	case "name":
+		n.Name = value
+	case "url":
+		n.Url = value
+	case "stats_filename":
+		n.StatsFilename = value
+	case "driver":
+		n.Driver = value
+	case "socket_timeout":
+		n.SocketTimeout, err = time.ParseDuration(value)
+	case "username":
+		n.Username = value
+	case "password":
+		n.Password = value
+	case "auth_source":
+		n.AuthSource = value
+	case "auth_mechanism":
+		n.AuthMechanism = value
+	case "direct":
+		n.Direct, err = strconv.ParseBool(value)
+	case "pool_limit":
+		n.PoolLimit, err = strconv.Atoi(value)
+	case "connect_timeout":
+		n.ConnectTimeout, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("unknown node setting %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("bad value for node setting %q: %s", key, err)
+	}
+	return nil
+}
+
+// ParseNodeConfig parses a node from a comma separated list of settings, i.e.
+// "name=challenger,url=mongodb://host1,host2/,driver=mongo-driver". The
+// settings have the same names as in node config files. Commas that are not
+// followed by a setting name are part of the value, so that urls can list
+// several hosts.
+func ParseNodeConfig(value string) (NodeConfig, error) {
+	var settings []string
+	for _, part := range strings.Split(value, ",") {
+		key := strings.SplitN(part, "=", 2)[0]
+		if len(settings) > 0 && !isNodeSetting(key) {
+			settings[len(settings)-1] += "," + part
+			continue
+		}
+		settings = append(settings, part)
+	}
+
+	var n NodeConfig
+	for _, setting := range settings {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return n, fmt.Errorf("node setting %q should look like key=value", setting)
+		}
+		if err := n.set(kv[0], kv[1]); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// LoadNodeConfigs reads the nodes from a json file like:
+//
+//	{"nodes": [
+//		{"name": "default", "url": "mongodb://localhost:27017"},
+//		{"name": "challenger", "url": "mongodb://host:27017", "driver": "mongo-driver",
+//		 "socket_timeout": "10s", "username": "user", "password": "pass", "pool_limit": 64}
+//	]}
+func LoadNodeConfigs(filename string) ([]NodeConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var content struct {
+		Nodes []map[string]interface{} `json:"nodes"`
+	}
+	if err := json.NewDecoder(file).Decode(&content); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", filename, err)
+	}
+
+	nodes := make([]NodeConfig, len(content.Nodes))
+	for i, settings := range content.Nodes {
+		for key, value := range settings {
+			text := fmt.Sprint(value)
+			// fmt would write large numbers with an exponent
+			if number, ok := value.(float64); ok {
+				text = strconv.FormatFloat(number, 'f', -1, 64)
+			}
+			if err := nodes[i].set(key, text); err != nil {
+				return nil, fmt.Errorf("node #%d in %s: %s", i, filename, err)
+			}
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,88 @@
+package flashback
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestParseNodeConfig(t *testing.T) {
+	t.Parallel()
+
+	node, err := ParseNodeConfig("name=challenger,url=mongodb://host1:27017,host2:27017/?replicaSet=rs," +
+		"driver=mongo-driver,socket_timeout=10s,username=user,password=a,b,direct=true,pool_limit=64")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, node, NodeConfig{
+		Name:          "challenger",
+		Url:           "mongodb://host1:27017,host2:27017/?replicaSet=rs",
+		Driver:        MongoGoDriver,
+		SocketTimeout: 10 * time.Second,
+		Username:      "user",
+		Password:      "a,b",
+		Direct:        true,
+		PoolLimit:     64,
+	})
+
+	for _, bad := range []string{
+		"url",
+		"=a,name=b",
+		"name=a,socket_timeout=soon",
+		"name=a,pool_limit=many",
+		"color=blue",
+	} {
+		_, err := ParseNodeConfig(bad)
+		ensure.NotNil(t, err)
+	}
+}
+
+func TestLoadNodeConfigs(t *testing.T) {
+	t.Parallel()
+
+	file, err := ioutil.TempFile("", "flashback_nodes")
+	ensure.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(`{"nodes": [
+		{"name": "default", "url": "mongodb://localhost:27017", "stats_filename": "default.csv"},
+		{"name": "challenger", "url": "mongodb://host:27017", "socket_timeout": "5s", "direct": true,
+		 "pool_limit": 8, "auth_source": "admin", "auth_mechanism": "SCRAM-SHA-256"}
+	]}`)
+	file.Close()
+
+	nodes, err := LoadNodeConfigs(file.Name())
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, nodes, []NodeConfig{
+		{Name: "default", Url: "mongodb://localhost:27017", StatsFilename: "default.csv"},
+		{
+			Name:          "challenger",
+			Url:           "mongodb://host:27017",
+			SocketTimeout: 5 * time.Second,
+			Direct:        true,
+			PoolLimit:     8,
+			AuthSource:    "admin",
+			AuthMechanism: "SCRAM-SHA-256",
+		},
+	})
+
+	file, err = ioutil.TempFile("", "flashback_nodes")
+	ensure.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(`{"nodes": [{"name": "default", "speed": "fast"}]}`)
+	file.Close()
+	_, err = LoadNodeConfigs(file.Name())
+	ensure.NotNil(t, err)
+
+	file, err = ioutil.TempFile("", "flashback_nodes")
+	ensure.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(`{"nodes": [{"name": "default", "pool_limit": 1000000}]}`)
+	file.Close()
+	nodes, err = LoadNodeConfigs(file.Name())
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, nodes[0].PoolLimit, 1000000)
+
+	_, err = LoadNodeConfigs("/nonexistent/nodes.json")
+	ensure.NotNil(t, err)
+}
@@ -49,6 +49,78 @@ type Op struct {
 	UpdateDoc  bson.D    `bson:"updateobj,omitempty"`
 	Database   string    `bson:",omitempty"`
 	Collection string    `bson:",omitempty"`
+	// Whether an update inserts a document when none matches, as the profiler
+	// recorded it
+	Upsert bool `bson:"upsert,omitempty"`
+	// The client that issued the op when it was recorded, i.e. the
+	// profiler's "client" field. Empty for the ops converted from a pcap.
+	Client string `bson:"client,omitempty"`
+	// How long the op took when it was recorded, as reported by the profiler
+	Millis int64 `bson:"millis,omitempty"`
+	// Which copy of the trace the op belongs to when the workload is amplified
+	Copy int `bson:"-"`
+	// The host that served the op when it was recorded, if the recorder
+	// tagged it
+	Host string `bson:"host,omitempty"`
+	// The read preference mode the op was recorded with, i.e.
+	// "secondaryPreferred", taken from its $readPreference
+	ReadPreference ReadMode `bson:"readPreference,omitempty"`
+	// The writeConcern the op was recorded with, if the recorder kept it
+	RecordedWriteConcern bson.D `bson:"writeConcern,omitempty"`
+	// Server-side time limit of queries and commands, sent as maxTimeMS
+	MaxTime time.Duration `bson:"-"`
+	// Where the op is replayed, see RouteRule
+	ReadMode ReadMode `bson:"-"`
+	Session  string   `bson:"-"`
+	// How the op is acknowledged if it's a write, and what it reads if it's
+	// a read. Empty for the defaults of the driver.
+	WriteConcern WriteConcern `bson:"-"`
+	ReadConcern  string       `bson:"-"`
+}
+
+// copyOp copies op along with its documents, so that the copy can be modified
+// without changing op
+func copyOp(op *Op) *Op {
+	copied := *op
+	copied.QueryDoc = copyDoc(op.QueryDoc)
+	copied.CommandDoc = copyDoc(op.CommandDoc)
+	copied.InsertDoc = copyDoc(op.InsertDoc)
+	copied.UpdateDoc = copyDoc(op.UpdateDoc)
+	copied.RecordedWriteConcern = copyDoc(op.RecordedWriteConcern)
+	return &copied
+}
+
+func copyDoc(doc bson.D) bson.D {
+	if doc == nil {
+		return nil
+	}
+	copied := make(bson.D, len(doc))
+	for i, elem := range doc {
+		copied[i] = bson.DocElem{elem.Name, copyValue(elem.Value)}
+	}
+	return copied
+}
+
+// copyValue copies the documents and arrays found in a document, the other
+// values can be shared
+func copyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case bson.D:
+		return copyDoc(value)
+	case bson.M:
+		copied := make(bson.M, len(value))
+		for key, v := range value {
+			copied[key] = copyValue(v)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, v := range value {
+			copied[i] = copyValue(v)
+		}
+		return copied
+	}
+	return value
 }
 
 // GetElem is a helper to fetch a specific key from bson.D
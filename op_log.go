@@ -0,0 +1,94 @@
+package flashback
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FailedOp is an op that failed on a node, the way it is written to the
+// failed ops file. ByLineOpsReader reads it back as a plain op, so that the
+// failures can be replayed again.
+type FailedOp struct {
+	Op            `bson:",inline"`
+	Node          string `bson:"node"`
+	Error         string `bson:"error"`
+	LatencyMicros int64  `bson:"latencyMicros"`
+}
+
+// SlowOp is an op that was slower than its threshold on at least one node,
+// the way it is written to the slow ops file. Like FailedOp, it can be read
+// back with ByLineOpsReader.
+type SlowOp struct {
+	Op              `bson:",inline"`
+	ThresholdMicros int64 `bson:"thresholdMicros"`
+	// The latency of the op on every node
+	LatencyMicros map[string]int64 `bson:"latencyMicros"`
+}
+
+// recordedOp is a copy of op the way it was recorded, as commands are
+// canonicalized in place
+func recordedOp(op *Op) Op {
+	recorded := *op
+	if (op.Type == Count || op.Type == FindAndModify) && len(op.CommandDoc) > 0 {
+		recorded.Type = Command
+	}
+	return recorded
+}
+
+func micros(d time.Duration) int64 {
+	return int64(d / time.Microsecond)
+}
+
+// opLog writes ops, along with what happened to them, to a BSON file
+type opLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func newOpLog(filename string) (*opLog, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &opLog{file: file}, nil
+}
+
+func (l *opLog) write(doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.file.Write(data)
+	return err
+}
+
+func (l *opLog) writeFailedOp(node string, op *Op, err error, latency time.Duration) error {
+	return l.write(FailedOp{
+		Op:            recordedOp(op),
+		Node:          node,
+		Error:         err.Error(),
+		LatencyMicros: micros(latency),
+	})
+}
+
+func (l *opLog) writeSlowOp(op *Op, threshold time.Duration, latencies map[string]time.Duration) error {
+	slow := SlowOp{
+		Op:              recordedOp(op),
+		ThresholdMicros: micros(threshold),
+		LatencyMicros:   make(map[string]int64, len(latencies)),
+	}
+	for node, latency := range latencies {
+		slow.LatencyMicros[node] = micros(latency)
+	}
+	return l.write(slow)
+}
+
+func (l *opLog) close() {
+	l.file.Close()
+}
@@ -0,0 +1,87 @@
+package flashback
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFailedOpLog(t *testing.T) {
+	t.Parallel()
+
+	file, err := ioutil.TempFile("", "flashback_failed_ops")
+	ensure.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	timestamp := time.Unix(1396456709, 0)
+	insert := &Op{Ns: "db.coll", Timestamp: timestamp, Type: Insert, InsertDoc: bson.D{{"_id", 1}}}
+	count := &Op{Ns: "db.$cmd", Timestamp: timestamp, Type: Command,
+		CommandDoc: bson.D{{"count", "coll"}, {"query", bson.D{{"a", 1}}}}}
+	normalizeOp(insert)
+	normalizeOp(count)
+	count = CanonicalizeOp(count)
+
+	log, err := newOpLog(file.Name())
+	ensure.Nil(t, err)
+	ensure.Nil(t, log.writeFailedOp("default", insert, errors.New("E11000 duplicate key error"), 3*time.Millisecond))
+	ensure.Nil(t, log.writeFailedOp("challenger", count, DeadlineExceeded, time.Second))
+	log.close()
+	// the op itself is left as is
+	ensure.DeepEqual(t, count.Type, Count)
+
+	readerLogger, _ := NewLogger("", "")
+	err, reader := NewFileByLineOpsReader(file.Name(), readerLogger, "")
+	ensure.Nil(t, err)
+	defer reader.Close()
+	op := reader.Next()
+	ensure.DeepEqual(t, op.Type, Insert)
+	ensure.DeepEqual(t, op.InsertDoc, bson.D{{"_id", 1}})
+	ensure.DeepEqual(t, op.Collection, "coll")
+	op = reader.Next()
+	ensure.DeepEqual(t, op.Type, Command)
+	ensure.DeepEqual(t, CanonicalizeOp(op).Type, Count)
+	ensure.DeepEqual(t, op.Collection, "coll")
+	ensure.True(t, reader.Next() == nil)
+
+	data, err := ioutil.ReadFile(file.Name())
+	ensure.Nil(t, err)
+	var failed FailedOp
+	ensure.Nil(t, bson.Unmarshal(data, &failed))
+	ensure.DeepEqual(t, failed.Node, "default")
+	ensure.DeepEqual(t, failed.Error, "E11000 duplicate key error")
+	ensure.DeepEqual(t, failed.LatencyMicros, int64(3000))
+}
+
+func TestSlowOpLog(t *testing.T) {
+	t.Parallel()
+
+	file, err := ioutil.TempFile("", "flashback_slow_ops")
+	ensure.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	update := &Op{Ns: "db.coll", Type: Update, QueryDoc: bson.D{{"_id", 1}},
+		UpdateDoc: bson.D{{"$set", bson.D{{"a", 1}}}}}
+	normalizeOp(update)
+	log, err := newOpLog(file.Name())
+	ensure.Nil(t, err)
+	ensure.Nil(t, log.writeSlowOp(update, 100*time.Millisecond,
+		map[string]time.Duration{"default": 20 * time.Millisecond, "challenger": 150 * time.Millisecond}))
+	log.close()
+
+	data, err := ioutil.ReadFile(file.Name())
+	ensure.Nil(t, err)
+	var slow SlowOp
+	ensure.Nil(t, bson.Unmarshal(data, &slow))
+	ensure.DeepEqual(t, slow.Type, Update)
+	ensure.DeepEqual(t, slow.QueryDoc, update.QueryDoc)
+	ensure.DeepEqual(t, slow.UpdateDoc, update.UpdateDoc)
+	ensure.DeepEqual(t, slow.ThresholdMicros, int64(100000))
+	ensure.DeepEqual(t, slow.LatencyMicros, map[string]int64{"default": 20000, "challenger": 150000})
+}
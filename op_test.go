@@ -80,3 +80,22 @@ func TestGetElem(t *testing.T) {
 	ensure.False(t, exists)
 	ensure.Nil(t, value)
 }
+
+func TestCopyOp(t *testing.T) {
+	t.Parallel()
+
+	op := &Op{
+		Ns:        "db.coll",
+		Type:      Update,
+		QueryDoc:  bson.D{{"tags", []interface{}{"a", bson.D{{"b", 1}}}}},
+		UpdateDoc: bson.D{{"$set", bson.M{"email": "a@b.c"}}},
+	}
+	copied := copyOp(op)
+	ensure.DeepEqual(t, copied, op)
+
+	copied.QueryDoc[0].Value.([]interface{})[1].(bson.D)[0].Value = 2
+	copied.UpdateDoc[0].Value.(bson.M)["email"] = "d@e.f"
+	ensure.DeepEqual(t, op.QueryDoc, bson.D{{"tags", []interface{}{"a", bson.D{{"b", 1}}}}})
+	ensure.DeepEqual(t, op.UpdateDoc, bson.D{{"$set", bson.M{"email": "a@b.c"}}})
+	ensure.True(t, copied.CommandDoc == nil)
+}
@@ -2,10 +2,15 @@ package flashback
 
 import (
 	"fmt"
+	"hash/fnv"
+	"sync/atomic"
 	"time"
 )
 
-func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) chan *Op {
+// NewBestEffortOpsDispatcher preloads the ops and dispatches them as fast as
+// the workers can handle. control is optional; when it is given, dispatching
+// can be paused, stopped or limited to a rate.
+func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, control *DispatchControl) chan *Op {
 	queue := make([]*Op, opsSize, opsSize)
 	i := 0
 
@@ -33,7 +38,15 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 	// start a gorountine to dispatch these ops as fast as workers can handle.
 	go func() {
 		logger.Info("Started dispatching ops: as fast as possible")
+		var last time.Time
 		for i, op := range queue {
+			if control != nil {
+				if control.throttle(last) {
+					logger.Info("Dispatching stopped")
+					break
+				}
+				last = time.Now()
+			}
 			queue[i] = nil
 			opChannel <- op
 		}
@@ -44,31 +57,200 @@ func NewBestEffortOpsDispatcher(reader OpsReader, opsSize int, logger *Logger) c
 	return opChannel
 }
 
-func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, speedup float64) chan *Op {
+// LateOpPolicy decides what a time-based dispatcher does with an op once it
+// lags the scaled trace clock by more than the configured threshold.
+type LateOpPolicy string
+
+const (
+	// LateOpContinue dispatches late ops anyway, only keeping track of the lag
+	LateOpContinue LateOpPolicy = "continue"
+	// LateOpDrop skips ops that are too late and counts them
+	LateOpDrop LateOpPolicy = "drop"
+	// LateOpAbort stops dispatching altogether
+	LateOpAbort LateOpPolicy = "abort"
+)
+
+// ReplaySchedule controls how a time-based dispatcher maps the ops' timestamps
+// onto the wall clock, and keeps track of how far the dispatcher falls behind
+// that schedule. It is safe for concurrent use, so the stats analyzers can
+// read it while the dispatcher updates it.
+type ReplaySchedule struct {
+	// Once an op is later than Threshold, Policy decides what to do with it.
+	// A zero Threshold turns the policy off.
+	Threshold time.Duration
+	Policy    LateOpPolicy
+	// Gaps between consecutive ops that are longer than MaxIdleGap (in trace
+	// time) are shortened to MaxIdleGap. Zero keeps all the gaps.
+	MaxIdleGap time.Duration
+
+	lag         int64
+	maxLag      int64
+	opsDropped  int64
+	aborted     int32
+	idleRemoved int64
+}
+
+func NewReplaySchedule(threshold time.Duration, policy LateOpPolicy) (*ReplaySchedule, error) {
+	switch policy {
+	case LateOpContinue, LateOpDrop, LateOpAbort:
+	default:
+		return nil, fmt.Errorf("unknown late op policy: %s", policy)
+	}
+	return &ReplaySchedule{Threshold: threshold, Policy: policy}, nil
+}
+
+// update records the latest lag and returns true if it exceeds the threshold
+func (s *ReplaySchedule) update(lag time.Duration) bool {
+	atomic.StoreInt64(&s.lag, int64(lag))
+	for {
+		max := atomic.LoadInt64(&s.maxLag)
+		if int64(lag) <= max || atomic.CompareAndSwapInt64(&s.maxLag, max, int64(lag)) {
+			break
+		}
+	}
+	return s.Threshold > 0 && lag > s.Threshold
+}
+
+// compressGap returns how much of the gap between two consecutive ops has to
+// be cut to honor MaxIdleGap, and accounts for it.
+func (s *ReplaySchedule) compressGap(gap time.Duration) time.Duration {
+	if s.MaxIdleGap <= 0 || gap <= s.MaxIdleGap {
+		return 0
+	}
+	removed := gap - s.MaxIdleGap
+	atomic.AddInt64(&s.idleRemoved, int64(removed))
+	return removed
+}
+
+// Lag returns how far behind schedule the latest dispatched op was
+func (s *ReplaySchedule) Lag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.lag))
+}
+
+// MaxLag returns the largest lag seen so far
+func (s *ReplaySchedule) MaxLag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.maxLag))
+}
+
+// OpsDropped returns how many ops were skipped under the LateOpDrop policy
+func (s *ReplaySchedule) OpsDropped() int64 {
+	return atomic.LoadInt64(&s.opsDropped)
+}
+
+// Aborted tells if dispatching was stopped under the LateOpAbort policy
+func (s *ReplaySchedule) Aborted() bool {
+	return atomic.LoadInt32(&s.aborted) != 0
+}
+
+// IdleTimeRemoved returns how much trace time was cut by MaxIdleGap so far
+func (s *ReplaySchedule) IdleTimeRemoved() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.idleRemoved))
+}
+
+// NewByTimeOpsDispatcher replays ops in accordance to their timestamps.
+// schedule is optional; when it is given, idle gaps are compressed and the
+// dispatcher records how far it falls behind schedule, applying the late op
+// policy once the lag goes over the threshold. control is optional too; when
+// it is given, dispatching can be paused, stopped or sped up, in which case
+// speedup is ignored in favor of the control's.
+func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, speedup float64,
+	schedule *ReplaySchedule, control *DispatchControl) chan *Op {
 	opChannel := make(chan *Op, 5000)
+	if control != nil {
+		speedup = control.Speedup()
+	}
 	go func() {
 		logger.Info(fmt.Sprintf("Started replaying ops by time with speedup of %f", speedup))
-		now_epoch := time.Unix(0, 0)
-		epoch := time.Unix(0, 0)
+		var (
+			epoch    time.Time
+			previous time.Time
+			removed  time.Duration
+			// The scaled trace clock, which read traceAnchor at wallAnchor.
+			// Both are moved whenever the clock is paused or its speed changes.
+			traceAnchor time.Duration
+			wallAnchor  time.Time
+		)
+		clock := func(now time.Time) time.Duration {
+			return traceAnchor + time.Duration(float64(now.Sub(wallAnchor))*speedup)
+		}
+		rebase := func(now time.Time) {
+			traceAnchor = clock(now)
+			wallAnchor = now
+		}
+
+	dispatch:
 		for i := 0; i < opsSize && !reader.AllLoaded(); i++ {
 			op := reader.Next()
 			if op == nil {
 				break
 			}
-			if epoch.Unix() == 0 {
+			if epoch.IsZero() {
 				epoch = op.Timestamp
-				now_epoch = time.Now()
+				wallAnchor = time.Now()
+			} else if schedule != nil {
+				removed += schedule.compressGap(op.Timestamp.Sub(previous))
 			}
+			previous = op.Timestamp
+
+			// wait for the op's turn, then figure out how late it is
+			elapsed := op.Timestamp.Sub(epoch) - removed
+			var late time.Duration
+			for {
+				var changed <-chan struct{}
+				if control != nil {
+					changed = control.Changed()
+					if control.Paused() {
+						// the trace clock doesn't move while paused
+						rebase(time.Now())
+						if control.waitWhilePaused() {
+							logger.Info("Dispatching stopped")
+							break dispatch
+						}
+						wallAnchor = time.Now()
+					}
+					if control.Stopped() {
+						logger.Info("Dispatching stopped")
+						break dispatch
+					}
+					if newSpeedup := control.Speedup(); newSpeedup != speedup {
+						rebase(time.Now())
+						speedup = newSpeedup
+						logger.Infof("Speedup changed to %f", speedup)
+					}
+				}
 
-			elapsed := op.Timestamp.Sub(epoch)
-			currentElapsed := time.Now().Sub(now_epoch)
-			currentElapsedScaled := time.Duration(float64(currentElapsed/time.Nanosecond) * speedup)
-			if elapsed > currentElapsedScaled {
-				time.Sleep(elapsed - currentElapsedScaled)
+				current := clock(time.Now())
+				if elapsed <= current {
+					late = current - elapsed
+					break
+				}
+				wait := time.Duration(float64(elapsed-current) / speedup)
+				if control == nil {
+					time.Sleep(wait)
+					break
+				} else if control.sleep(wait, changed) {
+					break
+				}
+			}
+
+			if schedule != nil && schedule.update(late) {
+				if schedule.Policy == LateOpDrop {
+					atomic.AddInt64(&schedule.opsDropped, 1)
+					continue
+				} else if schedule.Policy == LateOpAbort {
+					logger.Errorf("Aborting dispatch: op at %v is %v behind schedule, over the %v threshold",
+						op.Timestamp, late, schedule.Threshold)
+					atomic.StoreInt32(&schedule.aborted, 1)
+					break
+				}
 			}
 			opChannel <- op
 			if reader.OpsRead()%10000 == 0 {
 				logger.Info("Timestamp for latest op: ", op.Timestamp)
+				if schedule != nil {
+					logger.Infof("Schedule lag: %v (max %v), %d late ops dropped, %v of idle time removed",
+						schedule.Lag(), schedule.MaxLag(), schedule.OpsDropped(), schedule.IdleTimeRemoved())
+				}
 			}
 		}
 		logger.Info("Dispatching ended")
@@ -76,3 +258,60 @@ func NewByTimeOpsDispatcher(reader OpsReader, opsSize int, logger *Logger, speed
 	}()
 	return opChannel
 }
+
+// ShardOpsByClient splits the ops into one channel per worker. All the ops
+// recorded from the same client go to the same channel, so a worker replays
+// them in their original order. Ops with no recorded client are spread
+// across the channels in a round-robin fashion.
+func ShardOpsByClient(opsChan chan *Op, shards int) []chan *Op {
+	return shardOps(opsChan, shards, func(client string) int {
+		h := fnv.New32a()
+		h.Write([]byte(client))
+		return int(h.Sum32() % uint32(shards))
+	})
+}
+
+// AssignOpsToClients is like ShardOpsByClient, but gives each of the known
+// clients a channel of its own. Ops from clients that are not known are
+// spread across the channels in a round-robin fashion.
+func AssignOpsToClients(opsChan chan *Op, clients []string) []chan *Op {
+	clientIndex := make(map[string]int, len(clients))
+	for i, client := range clients {
+		clientIndex[client] = i
+	}
+	return shardOps(opsChan, len(clients), func(client string) int {
+		if i, ok := clientIndex[client]; ok {
+			return i
+		}
+		return -1
+	})
+}
+
+// shardOps dispatches each op to the channel picked by its client. A negative
+// pick means there is no preference.
+func shardOps(opsChan chan *Op, shards int, pick func(client string) int) []chan *Op {
+	shardChans := make([]chan *Op, shards)
+	for i := range shardChans {
+		shardChans[i] = make(chan *Op, 1000)
+	}
+
+	go func() {
+		next := 0
+		for op := range opsChan {
+			shard := -1
+			if op.Client != "" {
+				shard = pick(op.Client)
+			}
+			if shard < 0 {
+				shard = next
+				next = (next + 1) % shards
+			}
+			shardChans[shard] <- op
+		}
+		for _, shardChan := range shardChans {
+			close(shardChan)
+		}
+	}()
+
+	return shardChans
+}
@@ -0,0 +1,241 @@
+package flashback
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+// sliceOpsReader serves ops from memory so that dispatchers can be tested
+// without going through a file.
+type sliceOpsReader struct {
+	ops     []*Op
+	opsRead int
+	// how long to stall before returning any op but the first
+	delay  time.Duration
+	closed bool
+}
+
+func newSliceOpsReader(ops []*Op) *sliceOpsReader {
+	return &sliceOpsReader{ops: ops}
+}
+
+func (r *sliceOpsReader) Next() *Op {
+	if r.opsRead >= len(r.ops) {
+		return nil
+	}
+	if r.opsRead > 0 {
+		time.Sleep(r.delay)
+	}
+	op := r.ops[r.opsRead]
+	r.opsRead++
+	return op
+}
+
+func (r *sliceOpsReader) SkipOps(n int) error {
+	r.opsRead += n
+	return nil
+}
+
+func (r *sliceOpsReader) SetStartTime(int64) (int64, error) {
+	return 0, nil
+}
+
+func (r *sliceOpsReader) OpsRead() int {
+	return r.opsRead
+}
+
+func (r *sliceOpsReader) AllLoaded() bool {
+	return r.opsRead >= len(r.ops)
+}
+
+func (r *sliceOpsReader) Err() error {
+	return nil
+}
+
+func (r *sliceOpsReader) Close() {
+	r.closed = true
+}
+
+// makeTimedOps creates n ops that are interval apart from each other
+func makeTimedOps(n int, interval time.Duration) []*Op {
+	epoch := time.Unix(testTime, 0)
+	ops := make([]*Op, n)
+	for i := range ops {
+		ops[i] = &Op{
+			Ns:        "db.coll",
+			Timestamp: epoch.Add(time.Duration(i) * interval),
+			Type:      Insert,
+		}
+	}
+	return ops
+}
+
+func drain(opsChan chan *Op) int {
+	received := 0
+	for range opsChan {
+		received++
+	}
+	return received
+}
+
+func TestNewReplaySchedule(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []LateOpPolicy{LateOpContinue, LateOpDrop, LateOpAbort} {
+		schedule, err := NewReplaySchedule(time.Second, policy)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, schedule.Policy, policy)
+	}
+	_, err := NewReplaySchedule(time.Second, LateOpPolicy("ignore"))
+	ensure.NotNil(t, err)
+}
+
+func TestByTimeDispatcherLatePolicies(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	// All the ops share a timestamp but the reader stalls before handing
+	// out each one of them, so every op but the first is behind schedule.
+	test := func(policy LateOpPolicy) (int, *ReplaySchedule) {
+		schedule, err := NewReplaySchedule(time.Millisecond, policy)
+		ensure.Nil(t, err)
+		reader := newSliceOpsReader(makeTimedOps(5, 0))
+		reader.delay = 2 * time.Millisecond
+		return drain(NewByTimeOpsDispatcher(reader, 5, logger, 1.0, schedule, nil)), schedule
+	}
+
+	received, schedule := test(LateOpContinue)
+	ensure.DeepEqual(t, received, 5)
+	ensure.DeepEqual(t, schedule.OpsDropped(), int64(0))
+	ensure.False(t, schedule.Aborted())
+	ensure.True(t, schedule.MaxLag() >= 8*time.Millisecond)
+
+	received, schedule = test(LateOpDrop)
+	ensure.DeepEqual(t, received, 1)
+	ensure.DeepEqual(t, schedule.OpsDropped(), int64(4))
+	ensure.False(t, schedule.Aborted())
+
+	received, schedule = test(LateOpAbort)
+	ensure.DeepEqual(t, received, 1)
+	ensure.DeepEqual(t, schedule.OpsDropped(), int64(0))
+	ensure.True(t, schedule.Aborted())
+}
+
+func TestByTimeDispatcherOnSchedule(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	schedule, err := NewReplaySchedule(time.Second, LateOpAbort)
+	ensure.Nil(t, err)
+	reader := newSliceOpsReader(makeTimedOps(5, 10*time.Millisecond))
+	ensure.DeepEqual(t, drain(NewByTimeOpsDispatcher(reader, 5, logger, 1.0, schedule, nil)), 5)
+	ensure.False(t, schedule.Aborted())
+	ensure.DeepEqual(t, schedule.Lag(), time.Duration(0))
+	ensure.DeepEqual(t, schedule.IdleTimeRemoved(), time.Duration(0))
+}
+
+func TestByTimeDispatcherCompressesIdleGaps(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	// an hour of silence between the 2nd and 3rd op, which would time out the
+	// test if it was replayed as is.
+	ops := makeTimedOps(4, 10*time.Millisecond)
+	for _, op := range ops[2:] {
+		op.Timestamp = op.Timestamp.Add(time.Hour)
+	}
+	schedule, err := NewReplaySchedule(0, LateOpContinue)
+	ensure.Nil(t, err)
+	schedule.MaxIdleGap = 20 * time.Millisecond
+
+	start := time.Now()
+	ensure.DeepEqual(t, drain(NewByTimeOpsDispatcher(newSliceOpsReader(ops), 4, logger, 1.0, schedule, nil)), 4)
+	ensure.True(t, time.Now().Sub(start) >= 40*time.Millisecond)
+	ensure.DeepEqual(t, schedule.IdleTimeRemoved(), time.Hour-10*time.Millisecond)
+}
+
+func TestCompressGap(t *testing.T) {
+	t.Parallel()
+
+	schedule, err := NewReplaySchedule(0, LateOpContinue)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, schedule.compressGap(time.Hour), time.Duration(0))
+
+	schedule.MaxIdleGap = 2 * time.Second
+	ensure.DeepEqual(t, schedule.compressGap(time.Second), time.Duration(0))
+	ensure.DeepEqual(t, schedule.compressGap(2*time.Second), time.Duration(0))
+	ensure.DeepEqual(t, schedule.compressGap(5*time.Second), 3*time.Second)
+	ensure.DeepEqual(t, schedule.compressGap(time.Minute), 58*time.Second)
+	ensure.DeepEqual(t, schedule.IdleTimeRemoved(), 61*time.Second)
+}
+
+func TestShardOpsByClient(t *testing.T) {
+	t.Parallel()
+
+	clients := []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000", ""}
+	opsChan := make(chan *Op, 100)
+	for i := 0; i < 100; i++ {
+		opsChan <- &Op{
+			Ns:        "db.coll",
+			Timestamp: time.Unix(testTime, int64(i)),
+			Type:      Insert,
+			Client:    clients[i%len(clients)],
+		}
+	}
+	close(opsChan)
+
+	shards := ShardOpsByClient(opsChan, 3)
+	ensure.DeepEqual(t, len(shards), 3)
+
+	// every client but the unknown one sticks to a single shard, and its ops
+	// keep their original order
+	shardOfClient := map[string]int{}
+	lastSeen := map[string]time.Time{}
+	received := 0
+	for i, shard := range shards {
+		for op := range shard {
+			received++
+			if op.Client == "" {
+				continue
+			}
+			if prev, ok := shardOfClient[op.Client]; ok {
+				ensure.DeepEqual(t, prev, i)
+			}
+			shardOfClient[op.Client] = i
+			ensure.True(t, op.Timestamp.After(lastSeen[op.Client]))
+			lastSeen[op.Client] = op.Timestamp
+		}
+	}
+	ensure.DeepEqual(t, received, 100)
+	ensure.DeepEqual(t, len(shardOfClient), 3)
+}
+
+func TestAssignOpsToClients(t *testing.T) {
+	t.Parallel()
+
+	clients := []string{"a", "b", "c"}
+	opsChan := make(chan *Op, 100)
+	for i := 0; i < 100; i++ {
+		client := ""
+		if i%5 != 0 {
+			client = clients[i%len(clients)]
+		}
+		opsChan <- &Op{Ns: "db.coll", Type: Insert, Client: client}
+	}
+	close(opsChan)
+
+	shards := AssignOpsToClients(opsChan, clients)
+	ensure.DeepEqual(t, len(shards), len(clients))
+	received := 0
+	for i, shard := range shards {
+		for op := range shard {
+			received++
+			if op.Client != "" {
+				ensure.DeepEqual(t, op.Client, clients[i])
+			}
+		}
+	}
+	ensure.DeepEqual(t, received, 100)
+}
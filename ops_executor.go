@@ -1,37 +1,51 @@
 package flashback
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
 
 	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 var (
 	NotSupported = errors.New("op type not supported")
+	// DeadlineExceeded is the error of the ops that take longer than the
+	// executor's deadline, see SetDeadline
+	DeadlineExceeded = errors.New("op deadline exceeded")
 )
 
-type execute func(op *Op, collection *mgo.Collection) error
+type execute func(ctx context.Context, op *Op) (interface{}, error)
 
 type OpsExecutor struct {
-	session   *mgo.Session
+	backend   ExecutorBackend
 	statsChan chan OpStat
 	logger    *Logger
 
-	// keep track of the results retrieved by find(). For verification purpose
-	// only.
+	// keep track of the results retrieved by find(), count() and
+	// findAndModify(), and of the outcome of updates and removes. For
+	// verification purpose only.
 	lastResult  interface{}
 	lastLatency time.Duration
 	subExecutes map[OpType]execute
+	deadline    time.Duration
+	retryPolicy RetryPolicy
 }
 
+// NewOpsExecutor creates an executor that runs the ops through mgo
 func NewOpsExecutor(session *mgo.Session, statsChan chan OpStat, logger *Logger) *OpsExecutor {
+	return NewBackendOpsExecutor(NewMgoBackend(session), statsChan, logger)
+}
+
+// NewBackendOpsExecutor creates an executor that runs the ops through any
+// backend
+func NewBackendOpsExecutor(backend ExecutorBackend, statsChan chan OpStat, logger *Logger) *OpsExecutor {
 	e := &OpsExecutor{
-		session:   session,
-		statsChan: statsChan,
-		logger:    logger,
+		backend:     backend,
+		statsChan:   statsChan,
+		logger:      logger,
+		retryPolicy: DefaultRetryPolicy,
 	}
 
 	e.subExecutes = map[OpType]execute{
@@ -46,65 +60,46 @@ func NewOpsExecutor(session *mgo.Session, statsChan chan OpStat, logger *Logger)
 	return e
 }
 
-func (e *OpsExecutor) execQuery(op *Op, coll *mgo.Collection) error {
-	query := coll.Find(op.QueryDoc)
-	if op.NToSkip != 0 {
-		query.Skip(int(op.NToSkip))
-	}
-	if op.NToReturn != 0 {
-		query.Limit(int(op.NToReturn))
-	}
-	result := []Document{}
-	err := query.All(&result)
-	e.lastResult = &result
-	return err
+// SetDeadline makes the ops that take longer than deadline fail with
+// DeadlineExceeded, retries included. The backend gives up on them, see
+// ExecutorBackend. Zero means no deadline.
+func (e *OpsExecutor) SetDeadline(deadline time.Duration) {
+	e.deadline = deadline
 }
 
-func (e *OpsExecutor) execInsert(op *Op, coll *mgo.Collection) error {
-	return coll.Insert(op.InsertDoc)
+// SetRetryPolicy replaces DefaultRetryPolicy
+func (e *OpsExecutor) SetRetryPolicy(policy RetryPolicy) {
+	e.retryPolicy = policy
 }
 
-func (e *OpsExecutor) execUpdate(op *Op, coll *mgo.Collection) error {
-	return coll.Update(op.QueryDoc, op.UpdateDoc)
+func (e *OpsExecutor) execQuery(ctx context.Context, op *Op) (interface{}, error) {
+	result, err := e.backend.Query(ctx, op)
+	return &result, err
 }
 
-func (e *OpsExecutor) execRemove(op *Op, coll *mgo.Collection) error {
-	return coll.Remove(op.QueryDoc)
+func (e *OpsExecutor) execInsert(ctx context.Context, op *Op) (interface{}, error) {
+	return nil, e.backend.Insert(ctx, op)
 }
 
-func (e *OpsExecutor) execCount(op *Op, coll *mgo.Collection) error {
-	_, err := coll.Count()
-	return err
+func (e *OpsExecutor) execUpdate(ctx context.Context, op *Op) (interface{}, error) {
+	return e.backend.Update(ctx, op)
 }
 
-func (e *OpsExecutor) execFindAndModify(op *Op, coll *mgo.Collection) error {
-	result := Document{}
-	var query, update bson.D
+func (e *OpsExecutor) execRemove(ctx context.Context, op *Op) (interface{}, error) {
+	return e.backend.Remove(ctx, op)
+}
 
-	// Maybe clean this up later using a struct
-	if value, ok := GetElem(op.CommandDoc, "query"); ok {
-		if query, ok = value.(bson.D); !ok {
-			return fmt.Errorf("bad query document in findAndModify operation")
-		}
-	} else {
-		return fmt.Errorf("missing query document in findAndModify operation")
-	}
-	if value, ok := GetElem(op.CommandDoc, "update"); ok {
-		if update, ok = value.(bson.D); !ok {
-			return fmt.Errorf("bad update document in findAndModify operation")
-		}
-	} else {
-		return fmt.Errorf("missing update document in findAndModify operation")
-	}
+func (e *OpsExecutor) execCount(ctx context.Context, op *Op) (interface{}, error) {
+	return e.backend.Count(ctx, op)
+}
 
-	change := mgo.Change{Update: update}
-	_, err := coll.Find(query).Apply(change, result)
-	return err
+func (e *OpsExecutor) execFindAndModify(ctx context.Context, op *Op) (interface{}, error) {
+	return e.backend.FindAndModify(ctx, op)
 }
 
 // currently not supported
-func (e *OpsExecutor) skipGetMore(op *Op, coll *mgo.Collection) error {
-	return nil
+func (e *OpsExecutor) skipGetMore(ctx context.Context, op *Op) (interface{}, error) {
+	return nil, nil
 }
 
 // We only support handful op types. This function helps us to process supported
@@ -114,68 +109,86 @@ func (e *OpsExecutor) skipGetMore(op *Op, coll *mgo.Collection) error {
 // its job honestly and the consumer of these ops decide how to further process
 // the original ops.
 func CanonicalizeOp(op *Op) *Op {
+	op, _ = canonicalizeOp(op)
+	return op
+}
+
+// canonicalizeOp is CanonicalizeOp, which also tells why an op is dropped:
+// NotSupported for the commands other than count and findAndModify, or what
+// is wrong with a malformed command.
+func canonicalizeOp(op *Op) (*Op, error) {
 	if op.Type != Command {
-		return op
+		return op, nil
 	}
 
 	// the command to be run is the first element in the command document
-	// TODO: these unprotected type assertions aren't great, but one problem at at time
+	if len(op.CommandDoc) == 0 {
+		return nil, errors.New("empty command document")
+	}
 	cmd := op.CommandDoc[0]
 
 	if cmd.Name == "count" || cmd.Name == "findandmodify" {
-		collName := cmd.Value.(string)
+		collName, ok := cmd.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("bad collection name %v in %s command", cmd.Value, cmd.Name)
+		}
 
 		op.Type = OpType("command." + cmd.Name)
 		op.Collection = collName
-		return op
+		return op, nil
 	}
 
-	return nil
+	return nil, NotSupported
 }
 
-func retryOnSocketFailure(block func() error, session *mgo.Session, logger *Logger) error {
-	err := block()
-	if err == nil {
-		return nil
-	}
+func (e *OpsExecutor) Execute(op *Op) error {
+	startOp := time.Now()
+	e.lastResult = nil
 
-	switch err.(type) {
-	case *mgo.QueryError, *mgo.LastError:
+	op, err := canonicalizeOp(op)
+	if err != nil {
 		return err
 	}
+	subExecute, ok := e.subExecutes[op.Type]
+	if !ok {
+		return NotSupported
+	}
 
-	switch err {
-	case mgo.ErrNotFound, NotSupported:
+	ctx := context.Background()
+	if e.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.deadline)
+		defer cancel()
+	}
+	var result interface{}
+	block := func() (err error) {
+		result, err = subExecute(ctx, op)
 		return err
 	}
-
-	// Otherwise it's probably a socket error so we refresh the connection,
-	// and try again
-	session.Refresh()
-	logger.Error("retrying mongo query after error: ", err)
-	return block()
-}
-
-func (e *OpsExecutor) Execute(op *Op) error {
-	startOp := time.Now()
-
-	op = CanonicalizeOp(op)
-
-	block := func() error {
-		coll := e.session.DB(op.Database).C(op.Collection)
-		return e.subExecutes[op.Type](op, coll)
+	retries, err := e.retryPolicy.run(ctx, block, e.backend)
+	// whatever the op failed with, it ran out of time
+	if err != nil && ctx.Err() != nil {
+		err = DeadlineExceeded
+	}
+	if err != DeadlineExceeded {
+		e.lastResult = result
 	}
-	err := retryOnSocketFailure(block, e.session, e.logger)
 
 	latencyOp := time.Now().Sub(startOp)
 	e.lastLatency = latencyOp
 
 	if e.statsChan != nil {
 		if err == nil {
-			e.statsChan <- OpStat{op.Type, latencyOp, false}
+			e.statsChan <- OpStat{OpType: op.Type, Latency: latencyOp, OpError: false, Retries: retries,
+				Copy: op.Copy}
 		} else {
 			// error condition
-			e.statsChan <- OpStat{op.Type, latencyOp, true}
+			category, code := TimeoutError, 0
+			if err != DeadlineExceeded {
+				category, code = e.backend.Classify(err)
+			}
+			e.statsChan <- OpStat{OpType: op.Type, Latency: latencyOp, OpError: true, ErrorCategory: category,
+				ErrorCode: code, ErrorMessage: err.Error(), Retries: retries, Copy: op.Copy}
 		}
 	}
 
@@ -186,8 +199,17 @@ func (e *OpsExecutor) LastLatency() time.Duration {
 	return e.lastLatency
 }
 
+// LastResult is what the last op returned: a *[]Document for queries, an int
+// for counts, a Document for findAndModify and a *WriteOutcome for updates
+// and removes. It is nil for the other ops.
+func (e *OpsExecutor) LastResult() interface{} {
+	return e.lastResult
+}
+
 func safeGetInt(i interface{}) (int, error) {
 	switch i.(type) {
+	case int:
+		return i.(int), nil
 	case int32:
 		return int(i.(int32)), nil
 	case int64:
@@ -1,6 +1,7 @@
 package flashback
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -154,3 +155,67 @@ func TestSafeGetInt(t *testing.T) {
 	val, err = safeGetInt("a")
 	ensure.NotNil(t, err)
 }
+
+// slowBackend takes its time to answer queries, unless their context is done
+// first
+type slowBackend struct {
+	ExecutorBackend
+	delay     time.Duration
+	cancelled int
+}
+
+func (b *slowBackend) Query(ctx context.Context, op *Op) ([]Document, error) {
+	select {
+	case <-time.After(b.delay):
+		return []Document{{"_id": 1}}, nil
+	case <-ctx.Done():
+		b.cancelled++
+		return nil, ctx.Err()
+	}
+}
+
+func (b *slowBackend) Classify(err error) (ErrorCategory, int) { return OtherError, 0 }
+
+func TestExecutionDeadline(t *testing.T) {
+	statsChan := make(chan OpStat, 2)
+	logger, _ := NewLogger("", "")
+	backend := &slowBackend{delay: 100 * time.Millisecond}
+	exec := NewBackendOpsExecutor(backend, statsChan, logger)
+	op := &Op{Type: Query, Database: "db", Collection: "coll"}
+
+	exec.SetDeadline(10 * time.Millisecond)
+	ensure.DeepEqual(t, exec.Execute(op), DeadlineExceeded)
+	ensure.True(t, exec.LastResult() == nil)
+	ensure.True(t, exec.LastLatency() < 100*time.Millisecond)
+	// the backend gave up on the op before the next one
+	ensure.DeepEqual(t, backend.cancelled, 1)
+	stat := <-statsChan
+	ensure.True(t, stat.OpError)
+	ensure.DeepEqual(t, stat.ErrorCategory, TimeoutError)
+
+	exec.SetDeadline(time.Second)
+	ensure.Nil(t, exec.Execute(op))
+	ensure.DeepEqual(t, exec.LastResult(), &[]Document{{"_id": 1}})
+	stat = <-statsChan
+	ensure.False(t, stat.OpError)
+	ensure.DeepEqual(t, stat.ErrorCategory, ErrorCategory(""))
+}
+
+func TestCanonicalizeOp(t *testing.T) {
+	query := &Op{Type: Query, Database: "db", Collection: "coll"}
+	ensure.True(t, CanonicalizeOp(query) == query)
+
+	count := &Op{Type: Command, Database: "db", Collection: "$cmd", CommandDoc: bson.D{{"count", "coll"}}}
+	ensure.True(t, CanonicalizeOp(count) == count)
+	ensure.DeepEqual(t, count.Type, Count)
+	ensure.DeepEqual(t, count.Collection, "coll")
+
+	// malformed or unsupported commands are dropped
+	ensure.True(t, CanonicalizeOp(&Op{Type: Command}) == nil)
+	ensure.True(t, CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"count", 1}}}) == nil)
+	ensure.True(t, CanonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"isMaster", 1}}}) == nil)
+	_, err := canonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"isMaster", 1}}})
+	ensure.DeepEqual(t, err, NotSupported)
+	_, err = canonicalizeOp(&Op{Type: Command, CommandDoc: bson.D{{"findandmodify", bson.D{}}}})
+	ensure.StringContains(t, err.Error(), "bad collection name")
+}
@@ -2,9 +2,11 @@ package flashback
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -193,6 +195,9 @@ func normalizeOp(op *Op) {
 	dbName, collName := parts[0], parts[1]
 	op.Database = dbName
 	op.Collection = collName
+	if op.ReadPreference == "" {
+		op.ReadPreference = recordedReadPreference(op)
+	}
 }
 
 type CyclicOpsReader struct {
@@ -261,6 +266,300 @@ func (c *CyclicOpsReader) Close() {
 	c.reader.Close()
 }
 
+// AmplifiedOpsReader replays the same ops as several concurrent copies. Copy
+// i is shifted by i times the offset, and the ops of all the copies are
+// interleaved in the order of their shifted timestamps.
+//
+// The values of the rewriteKeys fields (typically _id and unique keys) are
+// made distinct for every copy but the first one, so that the inserts of the
+// copies don't collide: strings get a "_copy<i>" suffix and ObjectIds get
+// their process bytes scrambled. Values of other types are left as is.
+type AmplifiedOpsReader struct {
+	readers     []OpsReader
+	heads       []*Op
+	offset      time.Duration
+	rewriteKeys map[string]struct{}
+	logger      *Logger
+}
+
+// NewAmplifiedOpsReader reads every copy with a reader of its own, made by
+// maker. If one of them can't be made, the ones already made are closed.
+func NewAmplifiedOpsReader(maker func() (OpsReader, error), copies int, offset time.Duration,
+	rewriteKeys []string, logger *Logger) (*AmplifiedOpsReader, error) {
+	readers := make([]OpsReader, copies)
+	for i := range readers {
+		reader, err := maker()
+		if err != nil {
+			for _, opened := range readers[:i] {
+				opened.Close()
+			}
+			return nil, err
+		}
+		readers[i] = reader
+	}
+	keys := make(map[string]struct{}, len(rewriteKeys))
+	for _, key := range rewriteKeys {
+		keys[key] = struct{}{}
+	}
+
+	return &AmplifiedOpsReader{
+		readers:     readers,
+		heads:       make([]*Op, copies),
+		offset:      offset,
+		rewriteKeys: keys,
+		logger:      logger,
+	}, nil
+}
+
+func (a *AmplifiedOpsReader) Next() *Op {
+	next := -1
+	for i, reader := range a.readers {
+		if a.heads[i] == nil {
+			if a.heads[i] = reader.Next(); a.heads[i] == nil {
+				continue
+			}
+			a.amplify(a.heads[i], i)
+		}
+		if next < 0 || a.heads[i].Timestamp.Before(a.heads[next].Timestamp) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return nil
+	}
+
+	op := a.heads[next]
+	a.heads[next] = nil
+	return op
+}
+
+// amplify turns an op of the source into an op of the given copy
+func (a *AmplifiedOpsReader) amplify(op *Op, copyNum int) {
+	op.Copy = copyNum
+	if copyNum == 0 {
+		return
+	}
+	op.Timestamp = op.Timestamp.Add(time.Duration(copyNum) * a.offset)
+	if len(a.rewriteKeys) == 0 {
+		return
+	}
+
+	suffix := fmt.Sprintf("_copy%d", copyNum)
+	op.QueryDoc = a.rewriteDoc(op.QueryDoc, copyNum, suffix)
+	op.InsertDoc = a.rewriteDoc(op.InsertDoc, copyNum, suffix)
+	op.UpdateDoc = a.rewriteDoc(op.UpdateDoc, copyNum, suffix)
+	for i, elem := range op.CommandDoc {
+		if doc, ok := elem.Value.(bson.D); ok && (elem.Name == "query" || elem.Name == "update") {
+			op.CommandDoc[i].Value = a.rewriteDoc(doc, copyNum, suffix)
+		}
+	}
+}
+
+// rewriteDoc walks through the document, including nested documents like
+// $query, $set or $or, and rewrites the values of the keys to rewrite.
+func (a *AmplifiedOpsReader) rewriteDoc(doc bson.D, copyNum int, suffix string) bson.D {
+	for i, elem := range doc {
+		if _, ok := a.rewriteKeys[elem.Name]; ok {
+			doc[i].Value = rewriteValue(elem.Value, copyNum, suffix)
+		} else {
+			doc[i].Value = a.rewriteNested(elem.Value, copyNum, suffix)
+		}
+	}
+	return doc
+}
+
+func (a *AmplifiedOpsReader) rewriteNested(value interface{}, copyNum int, suffix string) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		return a.rewriteDoc(v, copyNum, suffix)
+	case []interface{}:
+		for i := range v {
+			v[i] = a.rewriteNested(v[i], copyNum, suffix)
+		}
+	}
+	return value
+}
+
+// rewriteValue makes a key's value unique to the copy. The value may also be
+// a query operator document like {$in: [...]}, whose operands are rewritten.
+func rewriteValue(value interface{}, copyNum int, suffix string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return v + suffix
+	case bson.ObjectId:
+		if !v.Valid() {
+			return v
+		}
+		// Changing the counter (the last 3 bytes) would turn an id into one
+		// the same process generated right before or after it, which is
+		// likely part of the trace as well. The bytes that identify the
+		// process are much less likely to collide.
+		id := []byte(v)
+		id[6] ^= byte(copyNum >> 16)
+		id[7] ^= byte(copyNum >> 8)
+		id[8] ^= byte(copyNum)
+		return bson.ObjectId(id)
+	case bson.D:
+		for i := range v {
+			v[i].Value = rewriteValue(v[i].Value, copyNum, suffix)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = rewriteValue(v[i], copyNum, suffix)
+		}
+	}
+	return value
+}
+
+func (a *AmplifiedOpsReader) OpsRead() int {
+	opsRead := 0
+	for _, reader := range a.readers {
+		opsRead += reader.OpsRead()
+	}
+	return opsRead
+}
+
+func (a *AmplifiedOpsReader) AllLoaded() bool {
+	for i, reader := range a.readers {
+		if a.heads[i] != nil || !reader.AllLoaded() {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *AmplifiedOpsReader) SkipOps(numSkipOps int) error {
+	for _, reader := range a.readers {
+		if err := reader.SkipOps(numSkipOps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AmplifiedOpsReader) SetStartTime(startTime int64) (int64, error) {
+	var numSkipped int64
+	for _, reader := range a.readers {
+		skipped, err := reader.SetStartTime(startTime)
+		if err != nil {
+			return numSkipped, err
+		}
+		numSkipped += skipped
+	}
+	return numSkipped, nil
+}
+
+func (a *AmplifiedOpsReader) Err() error {
+	for _, reader := range a.readers {
+		if err := reader.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AmplifiedOpsReader) Close() {
+	for _, reader := range a.readers {
+		reader.Close()
+	}
+}
+
+// FanOutOpsReader is one of several readers that get the same ops from a
+// shared reader, see NewFanOutOpsReaders. Each reader gets its own copy of
+// every op and of its documents, so that the ops can be modified
+// independently.
+type FanOutOpsReader struct {
+	source  OpsReader
+	ops     chan *Op
+	closed  chan struct{}
+	close   sync.Once
+	opsRead int
+	done    bool
+}
+
+// NewFanOutOpsReaders reads the ops of reader once, and hands each of them to
+// n readers that are consumed at their own pace. A reader can fall up to
+// bufferSize ops behind the fastest one; further behind, it holds the others
+// back. A reader that is closed stops getting ops, and the shared reader is
+// closed once all the ops are read or all the readers are closed.
+func NewFanOutOpsReaders(reader OpsReader, n int, bufferSize int) []*FanOutOpsReader {
+	branches := make([]*FanOutOpsReader, n)
+	for i := range branches {
+		branches[i] = &FanOutOpsReader{
+			source: reader,
+			ops:    make(chan *Op, bufferSize),
+			closed: make(chan struct{}),
+		}
+	}
+
+	go func() {
+		defer reader.Close()
+		for !reader.AllLoaded() {
+			op := reader.Next()
+			if op == nil {
+				break
+			}
+			open := 0
+			for _, branch := range branches {
+				select {
+				case branch.ops <- copyOp(op):
+					open++
+				case <-branch.closed:
+				}
+			}
+			if open == 0 {
+				break
+			}
+		}
+		for _, branch := range branches {
+			close(branch.ops)
+		}
+	}()
+
+	return branches
+}
+
+func (f *FanOutOpsReader) Next() *Op {
+	op, ok := <-f.ops
+	if !ok {
+		f.done = true
+		return nil
+	}
+	f.opsRead++
+	return op
+}
+
+func (f *FanOutOpsReader) OpsRead() int {
+	return f.opsRead
+}
+
+func (f *FanOutOpsReader) AllLoaded() bool {
+	return f.done
+}
+
+// SkipOps is not supported, skip the ops of the shared reader instead
+func (f *FanOutOpsReader) SkipOps(numSkipOps int) error {
+	return errors.New("ops can't be skipped on a fan-out reader")
+}
+
+// SetStartTime is not supported, set the start time of the shared reader
+// instead
+func (f *FanOutOpsReader) SetStartTime(startTime int64) (int64, error) {
+	return 0, errors.New("the start time can't be set on a fan-out reader")
+}
+
+// Err returns the error of the shared reader, once all the ops are read
+func (f *FanOutOpsReader) Err() error {
+	if !f.done {
+		return nil
+	}
+	return f.source.Err()
+}
+
+func (f *FanOutOpsReader) Close() {
+	f.close.Do(func() { close(f.closed) })
+}
+
 // Some operations are recorded with empty values for $set, $unset
 // When these are replayed against a mongo instance, they generate an error and do not execute
 // This method will detect and remove these empty blocks before the query is executed
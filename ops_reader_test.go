@@ -2,6 +2,7 @@ package flashback
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"testing"
@@ -271,3 +272,168 @@ func CheckTime(t *testing.T, pythonTime float64, goTime time.Time) {
 	ensure.DeepEqual(t, goTime.Unix(), int64(pythonTime)/1e3)
 	ensure.DeepEqual(t, goTime.UnixNano(), int64(pythonTime)*1e6)
 }
+
+func TestAmplifiedOpsReader(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	id := bson.ObjectIdHex("533c3d03c23fffd217678ee8")
+	maker := func() (OpsReader, error) {
+		return newSliceOpsReader([]*Op{
+			&Op{
+				Ns:        "db.coll",
+				Timestamp: time.Unix(testTime, 0),
+				Type:      Insert,
+				InsertDoc: bson.D{{"_id", id}, {"email", "a@b.c"}, {"n", 1}},
+			},
+			&Op{
+				Ns:        "db.coll",
+				Timestamp: time.Unix(testTime, int64(100*time.Millisecond)),
+				Type:      Update,
+				QueryDoc:  bson.D{{"$or", []interface{}{bson.D{{"email", bson.D{{"$in", []interface{}{"a@b.c"}}}}}}}},
+				UpdateDoc: bson.D{{"$set", bson.D{{"email", "d@e.f"}}}},
+			},
+		}), nil
+	}
+
+	reader, err := NewAmplifiedOpsReader(maker, 3, 30*time.Millisecond, []string{"_id", "email"}, logger)
+	ensure.Nil(t, err)
+
+	var ops []*Op
+	for op := reader.Next(); op != nil; op = reader.Next() {
+		ops = append(ops, op)
+	}
+	ensure.DeepEqual(t, len(ops), 6)
+	ensure.DeepEqual(t, reader.OpsRead(), 6)
+	ensure.True(t, reader.AllLoaded())
+
+	// the copies are shifted and interleaved
+	copies := []int{}
+	for i, op := range ops {
+		copies = append(copies, op.Copy)
+		if i > 0 {
+			ensure.False(t, op.Timestamp.Before(ops[i-1].Timestamp))
+		}
+	}
+	ensure.DeepEqual(t, copies, []int{0, 1, 2, 0, 1, 2})
+	ensure.DeepEqual(t, ops[2].Timestamp, time.Unix(testTime, int64(60*time.Millisecond)))
+
+	// the first copy is left untouched
+	ensure.DeepEqual(t, ops[0].InsertDoc, bson.D{{"_id", id}, {"email", "a@b.c"}, {"n", 1}})
+
+	// the keys of the other copies are rewritten, including nested ones
+	insertedId, _ := GetElem(ops[1].InsertDoc, "_id")
+	ensure.True(t, insertedId.(bson.ObjectId).Valid())
+	ensure.NotDeepEqual(t, insertedId, id)
+	ensure.DeepEqual(t, ops[1].InsertDoc[1:], bson.D{{"email", "a@b.c_copy1"}, {"n", 1}})
+	ensure.DeepEqual(t, ops[5].QueryDoc,
+		bson.D{{"$or", []interface{}{bson.D{{"email", bson.D{{"$in", []interface{}{"a@b.c_copy2"}}}}}}}})
+	ensure.DeepEqual(t, ops[5].UpdateDoc, bson.D{{"$set", bson.D{{"email", "d@e.f_copy2"}}}})
+}
+
+func TestAmplifiedObjectIds(t *testing.T) {
+	t.Parallel()
+
+	// ids generated one after the other by the same process
+	ids := []bson.ObjectId{
+		bson.ObjectIdHex("533c3d03c23fffd217678ee7"),
+		bson.ObjectIdHex("533c3d03c23fffd217678ee8"),
+		bson.ObjectIdHex("533c3d03c23fffd217678ee9"),
+	}
+	seen := make(map[bson.ObjectId]struct{})
+	for _, id := range ids {
+		seen[id] = struct{}{}
+	}
+	for copyNum := 1; copyNum <= 3; copyNum++ {
+		for _, id := range ids {
+			copied := rewriteValue(id, copyNum, "").(bson.ObjectId)
+			ensure.True(t, copied.Valid())
+			ensure.DeepEqual(t, copied.Time(), id.Time())
+			ensure.DeepEqual(t, copied.Counter(), id.Counter())
+			_, ok := seen[copied]
+			ensure.False(t, ok, copied)
+			seen[copied] = struct{}{}
+		}
+	}
+}
+
+func TestAmplifiedOpsReaderWithoutRewrite(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	reader, err := NewAmplifiedOpsReader(func() (OpsReader, error) {
+		return newSliceOpsReader([]*Op{
+			&Op{Ns: "db.coll", Timestamp: time.Unix(testTime, 0), Type: Insert, InsertDoc: bson.D{{"_id", "x"}}},
+		}), nil
+	}, 2, 0, nil, logger)
+	ensure.Nil(t, err)
+
+	first, second := reader.Next(), reader.Next()
+	ensure.DeepEqual(t, first.InsertDoc, second.InsertDoc)
+	ensure.DeepEqual(t, first.Timestamp, second.Timestamp)
+	ensure.DeepEqual(t, second.Copy, 1)
+	ensure.True(t, reader.Next() == nil)
+}
+
+func TestAmplifiedOpsReaderError(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	// the third copy can't be read, the first two are closed
+	var opened []*sliceOpsReader
+	maker := func() (OpsReader, error) {
+		if len(opened) == 2 {
+			return nil, errors.New("no such file")
+		}
+		reader := newSliceOpsReader(nil)
+		opened = append(opened, reader)
+		return reader, nil
+	}
+	reader, err := NewAmplifiedOpsReader(maker, 3, 0, nil, logger)
+	ensure.NotNil(t, err)
+	ensure.True(t, reader == nil)
+	ensure.True(t, opened[0].closed && opened[1].closed)
+}
+
+func TestFanOutOpsReaders(t *testing.T) {
+	t.Parallel()
+
+	ops := makeTimedOps(100, time.Millisecond)
+	branches := NewFanOutOpsReaders(newSliceOpsReader(ops), 3, 10)
+	ensure.DeepEqual(t, len(branches), 3)
+
+	// the last branch quits early, which doesn't hold the others back
+	for i := 0; i < 5; i++ {
+		ensure.NotNil(t, branches[2].Next())
+	}
+	branches[2].Close()
+
+	received := make(chan []*Op)
+	for _, branch := range branches[:2] {
+		go func(branch *FanOutOpsReader) {
+			var got []*Op
+			for !branch.AllLoaded() {
+				if op := branch.Next(); op != nil {
+					got = append(got, op)
+				}
+			}
+			received <- got
+		}(branch)
+	}
+	first, second := <-received, <-received
+
+	ensure.DeepEqual(t, len(first), 100)
+	ensure.DeepEqual(t, len(second), 100)
+	ensure.DeepEqual(t, branches[0].OpsRead(), 100)
+	ensure.Nil(t, branches[0].Err())
+	for i := range ops {
+		// every branch gets its own copy of the ops
+		ensure.DeepEqual(t, first[i].Timestamp, ops[i].Timestamp)
+		ensure.DeepEqual(t, second[i].Timestamp, ops[i].Timestamp)
+		ensure.True(t, first[i] != second[i] && first[i] != ops[i])
+	}
+
+	ensure.NotNil(t, branches[0].SkipOps(1))
+	_, err := branches[0].SetStartTime(testTime)
+	ensure.NotNil(t, err)
+}
@@ -9,7 +9,7 @@ from bson import BSON
 
 def dump_op(output, op):
     copier = utils.DictionaryCopier(op)
-    copier.copy_fields("ts", "ns", "op")
+    copier.copy_fields("ts", "ns", "op", "client", "millis", "host")
     op_type = op["op"]
 
     # handpick some essential fields to execute.
@@ -18,12 +18,16 @@ def dump_op(output, op):
     elif op_type == "insert":
         copier.copy_fields("o")
     elif op_type == "update":
-        copier.copy_fields("updateobj", "query")
+        copier.copy_fields("updateobj", "query", "upsert")
     elif op_type == "remove":
         copier.copy_fields("query")
     elif op_type == "command":
         copier.copy_fields("command")
 
+    # keep the write concern the client asked for, if the profiler saw it
+    if op_type != "command" and "writeConcern" in op.get("command", {}):
+        copier.dest["writeConcern"] = op["command"]["writeConcern"]
+
     output.write(BSON.encode(copier.dest))
 
 def merge_to_final_output(oplog_output_file, profiler_output_files, output_file):
@@ -111,6 +115,14 @@ def merge_to_final_output(oplog_output_file, profiler_output_files, output_file)
 
             oplog_doc["ts"] = profiler_doc["ts"]  # we still want to keep the canonical form of the ts
             oplog_doc["op"] = profiler_doc["op"]  # make sure "op" is "insert" instead of "i"
+            if "client" in profiler_doc:
+                oplog_doc["client"] = profiler_doc["client"]  # the oplog doesn't know who issued the insert
+            if "millis" in profiler_doc:
+                oplog_doc["millis"] = profiler_doc["millis"]
+            if "host" in profiler_doc:
+                oplog_doc["host"] = profiler_doc["host"]
+            if "command" in profiler_doc:
+                oplog_doc["command"] = profiler_doc["command"]
             dump_op(output, oplog_doc)
             inserts += 1
 
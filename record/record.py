@@ -19,7 +19,7 @@ from threading import Thread
 WRITER_THREAD_NAME = "write-all-docs-to-file"
 
 def tail_to_queue(tailer, identifier, doc_queue, state, end_time,
-                  check_duration_secs=1):
+                  check_duration_secs=1, host=None):
     """
     Accept a tailing cursor and serialize the retrieved documents to a fifo
     queue.
@@ -31,6 +31,8 @@ def tail_to_queue(tailer, identifier, doc_queue, state, end_time,
         we tail the profile collection.
     @param check_duration_secs: if we cannot retrieve the latest document,
         this queuing loop will sleep for that many seconds and then try again.
+    @param host: if set, the documents are tagged with the host that served
+        them, so that the replay can tell primary and secondary reads apart.
     """
     tailer_state = state.tailer_states[identifier]
     first_loop = True
@@ -73,6 +75,8 @@ def tail_to_queue(tailer, identifier, doc_queue, state, end_time,
             if state.timeout and tailer_state.last_received_ts >= end_time:
                 break
 
+            if host:
+                doc["host"] = host
             doc_queue.put_nowait((identifier, doc))
             tailer_state.entries_received += 1
 
@@ -357,7 +361,8 @@ class MongoQueryRecorder(object):
                     "thread": Thread(
                         target=tail_to_queue,
                         args=(tailer, tailer_id, doc_queue, state,
-                              end_datetime))
+                              end_datetime),
+                        kwargs={"host": server_string})
                 })
 
         # Deamonize each thread and start it
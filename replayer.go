@@ -0,0 +1,1354 @@
+package flashback
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayStyle decides how fast the ops are replayed
+type ReplayStyle string
+
+const (
+	// StressStyle replays the ops as fast as possible
+	StressStyle ReplayStyle = "stress"
+	// RealStyle replays the ops in accordance to their timestamps
+	RealStyle ReplayStyle = "real"
+)
+
+// ConcurrencyMode decides how the number of workers is inferred from the
+// recorded ops
+type ConcurrencyMode string
+
+const (
+	// ConcurrencyFromClients runs one worker per recorded client, which
+	// replays that client's ops in order. The clients are client addresses,
+	// not connections, see TraceConcurrency.
+	ConcurrencyFromClients ConcurrencyMode = "clients"
+	// ConcurrencyFromOverlap runs as many workers as the largest number of
+	// recorded ops running at the same time
+	ConcurrencyFromOverlap ConcurrencyMode = "overlap"
+)
+
+// PipelineMode decides how the nodes share the ops
+type PipelineMode string
+
+const (
+	// LockStepPipeline runs each op on all the nodes at the same time, and
+	// waits for all of them before the next op
+	LockStepPipeline PipelineMode = "lockstep"
+	// IndependentPipelines gives each node its own dispatcher and workers, fed
+	// from a shared reader, so that a slow node doesn't hold the others back
+	IndependentPipelines PipelineMode = "independent"
+)
+
+const (
+	// how far behind the other nodes a node can fall in independent pipelines
+	fanOutBufferSize = 10000
+
+	defaultReportInterval  = 5 * time.Second
+	defaultShutdownTimeout = 30 * time.Second
+	defaultSocketTimeout   = time.Minute
+
+	defaultMaxMismatchSamples = 1000
+)
+
+var (
+	ErrReplayAborted = errors.New("replay aborted: ops fell too far behind schedule")
+)
+
+// ReplayConfig holds the settings of a Replayer. Zero values of the optional
+// settings turn them off, or pick the same defaults as cmd/flashback.
+type ReplayConfig struct {
+	Style ReplayStyle
+	// The file for the serialized ops, generated by the record scripts
+	OpsFilename string
+	// [Optional] Used instead of OpsFilename to read the ops, i.e. to replay
+	// ops that are generated in memory. It is called once per pass over the
+	// ops.
+	NewOpsReader func() (OpsReader, error)
+	// The first node is the reference one, the others are challengers that
+	// get the same ops
+	Nodes []NodeConfig
+	// Defaults to LockStepPipeline
+	Pipeline PipelineMode
+
+	// Maximal amount of ops to be replayed. Defaults to math.MaxUint32.
+	MaxOps int
+	// Skip the first NumSkipOps ops
+	NumSkipOps int
+	// Unix timestamp of the first op to replay
+	StartTime int64
+	// Only execute ops of that particular type
+	OpFilter string
+	// In RealStyle, cycle through the ops infinitely
+	Cyclic bool
+
+	// In RealStyle, replay the ops this many times faster. Defaults to 1.
+	Speedup float64
+	// In StressStyle, limit the replay to this many ops/sec
+	Rate float64
+	// In RealStyle, LateOpPolicy kicks in once the replay falls behind the
+	// (scaled) timestamps of the ops by more than LateOpThreshold. Defaults
+	// to LateOpContinue.
+	LateOpThreshold time.Duration
+	LateOpPolicy    LateOpPolicy
+	// In RealStyle, gaps between two consecutive ops that are longer than
+	// MaxIdleGap (before speedup) are shortened to MaxIdleGap
+	MaxIdleGap time.Duration
+
+	// Number of workers that send ops to the nodes (to each node with
+	// IndependentPipelines), unless EmulateConcurrency is set
+	Workers int
+	// Replay all the ops recorded from the same client with the same worker,
+	// in their original order
+	PreserveClientOrder bool
+	EmulateConcurrency  ConcurrencyMode
+
+	// Replay the ops as this many concurrent copies, each shifted in time by
+	// AmplifyOffset from the previous one, and with the values of
+	// AmplifyRewriteKeys made distinct
+	Amplify            int
+	AmplifyOffset      time.Duration
+	AmplifyRewriteKeys []string
+
+	// Ops executed during the warmup are left out of the stats
+	Warmup    time.Duration
+	WarmupOps int64
+	// Stop the replay after this long, whatever the number of ops left
+	Duration time.Duration
+	// Once stopped, how long to wait for in-flight ops to finish. Defaults to
+	// 30s.
+	ShutdownTimeout time.Duration
+
+	// Mongo socket timeout of the nodes that don't have their own. Defaults
+	// to one minute.
+	SocketTimeout time.Duration
+	// [Optional] Server-side time limit per op type, sent as the maxTimeMS of
+	// queries, counts and findAndModify
+	MaxTime map[OpType]time.Duration
+	// [Optional] Client-side time limit of every op, retries included. The ops
+	// that go over it fail with DeadlineExceeded, without waiting for the node.
+	OpDeadline time.Duration
+	// [Optional] Send some ops to secondaries, or to sessions of their own,
+	// i.e. to reproduce the recorded read preferences. The first rule that
+	// matches an op decides where it goes, the other ops go to the primary.
+	Routes []RouteRule
+	// [Optional] How the writes are acknowledged, for all the namespaces or
+	// for some of them ("<database>.<collection>"). Defaults to the one of
+	// the driver.
+	WriteConcern            WriteConcern
+	WriteConcernByNamespace map[string]WriteConcern
+	// [Optional] Replay the writes that were recorded with a write concern
+	// with that one instead
+	HonorRecordedWriteConcern bool
+	// [Optional] The read concern level of queries and counts, for all the
+	// namespaces or for some of them. Only with MongoGoDriver, as mgo can't
+	// send one.
+	ReadConcern            string
+	ReadConcernByNamespace map[string]string
+	// [Optional] Which failed ops are run again, and when. Defaults to
+	// DefaultRetryPolicy.
+	Retry *RetryPolicy
+	// Ops that take longer than SlowOpThreshold on any node are logged
+	SlowOpThreshold time.Duration
+	// [Optional] Override SlowOpThreshold for some op types, or for some
+	// namespaces ("<database>.<collection>"). The threshold of a namespace
+	// wins over the one of an op type, and 0 leaves their ops out.
+	SlowOpThresholdByType      map[OpType]time.Duration
+	SlowOpThresholdByNamespace map[string]time.Duration
+	// [Optional] File that gets every slow op, with its query, update or
+	// command and its latency on every node. It can be read back with
+	// ByLineOpsReader.
+	SlowOpsFilename string
+	// [Optional] Compare the results that the challengers return to the ones
+	// of the reference node. Only with LockStepPipeline.
+	Verifier *ResultVerifier
+	// [Optional] File that gets a sample of the mismatches, up to
+	// MaxMismatchSamples of them (defaults to 1000)
+	MismatchFilename   string
+	MaxMismatchSamples int
+	// [Optional] File that gets every op that fails on any node, along with
+	// the node, the error and the latency. It can be read back with
+	// ByLineOpsReader to replay the failures again.
+	FailedOpsFilename string
+	// [Optional] Once the replay is over, hash every collection the ops
+	// touched on every node, and report the ones that differ from the
+	// reference node. Needs at least two nodes.
+	CheckDivergence bool
+	// [Optional] With CheckDivergence, compare the documents of the collections
+	// that diverged to sample up to this many differing _ids. The _ids and
+	// checksums of a whole collection are kept in memory while doing so.
+	MaxDivergenceSampleIds int
+	// [Optional] Once the replay is over, run explain on every node for the
+	// first op of each query shape, and write the plans to this file. The
+	// shapes whose plan differs between the reference node and a challenger
+	// are logged.
+	ExplainFilename string
+
+	// Defaults to 5s
+	ReportInterval time.Duration
+	// Log op errors
+	Verbose bool
+
+	// [Optional] Called at each report interval, and once the replay is over,
+	// for every node. Copies of amplified ops are reported as "<node>/copyN".
+	OnReport func(name string, status *ExecutionStatus)
+	// [Optional] Called when an op fails on a node
+	OnOpError func(node string, op *Op, err error)
+	// [Optional] Called when the result of an op on a challenger differs from
+	// the one of the reference node
+	OnMismatch func(node string, op *Op, diff string)
+	// [Optional] Called when an op is slower than SlowOpThreshold on at least
+	// one node, with its latency on every node
+	OnSlowOp func(op *Op, latencies map[string]time.Duration)
+}
+
+// validate checks the config and fills in the defaults
+func (c *ReplayConfig) validate() error {
+	if c.Style != StressStyle && c.Style != RealStyle {
+		return fmt.Errorf("invalid style %q, the only acceptable values are %q and %q",
+			c.Style, StressStyle, RealStyle)
+	}
+	if c.OpsFilename == "" && c.NewOpsReader == nil {
+		return errors.New("either OpsFilename or NewOpsReader is required")
+	}
+	if c.SocketTimeout < 0 {
+		return errors.New("socket timeout must not be negative")
+	}
+	if c.SocketTimeout == 0 {
+		c.SocketTimeout = defaultSocketTimeout
+	}
+	if len(c.Nodes) == 0 {
+		return errors.New("at least one node is required")
+	}
+	// the defaults are filled in on a copy of the caller's nodes
+	c.Nodes = append([]NodeConfig(nil), c.Nodes...)
+	names := make(map[string]struct{})
+	for i := range c.Nodes {
+		n := &c.Nodes[i]
+		if n.Name == "" {
+			return errors.New("every node needs a name")
+		}
+		if _, ok := names[n.Name]; ok {
+			return fmt.Errorf("duplicate node name %q", n.Name)
+		}
+		names[n.Name] = struct{}{}
+		if n.Driver != "" && n.Driver != MgoDriver && n.Driver != MongoGoDriver {
+			return fmt.Errorf("unknown driver %q for node %q", n.Driver, n.Name)
+		}
+		if n.SocketTimeout < 0 || n.ConnectTimeout < 0 || n.PoolLimit < 0 {
+			return fmt.Errorf("timeouts and pool limit of node %q must not be negative", n.Name)
+		}
+		if n.SocketTimeout == 0 {
+			n.SocketTimeout = c.SocketTimeout
+		}
+	}
+	if c.Pipeline == "" {
+		c.Pipeline = LockStepPipeline
+	} else if c.Pipeline != LockStepPipeline && c.Pipeline != IndependentPipelines {
+		return fmt.Errorf("invalid pipeline mode %q, the only acceptable values are %q and %q",
+			c.Pipeline, LockStepPipeline, IndependentPipelines)
+	}
+	if c.Verifier != nil {
+		if c.Pipeline != LockStepPipeline {
+			return errors.New("results can only be verified with lock-step pipelines")
+		}
+		if len(c.Nodes) < 2 {
+			return errors.New("results can only be verified with at least two nodes")
+		}
+	}
+	if c.CheckDivergence && len(c.Nodes) < 2 {
+		return errors.New("divergence can only be checked with at least two nodes")
+	}
+	if c.MaxDivergenceSampleIds < 0 {
+		return errors.New("MaxDivergenceSampleIds must not be negative")
+	}
+	if c.MaxMismatchSamples < 0 {
+		return errors.New("MaxMismatchSamples must not be negative")
+	}
+	if c.MaxMismatchSamples == 0 {
+		c.MaxMismatchSamples = defaultMaxMismatchSamples
+	}
+	if c.EmulateConcurrency != "" && c.EmulateConcurrency != ConcurrencyFromClients &&
+		c.EmulateConcurrency != ConcurrencyFromOverlap {
+		return fmt.Errorf("invalid concurrency mode %q, the only acceptable values are %q and %q",
+			c.EmulateConcurrency, ConcurrencyFromClients, ConcurrencyFromOverlap)
+	}
+	if c.EmulateConcurrency == "" && c.Workers <= 0 {
+		return errors.New("the number of workers must be a positive number")
+	}
+	if c.MaxOps < 0 || c.NumSkipOps < 0 {
+		return errors.New("MaxOps and NumSkipOps must not be negative")
+	}
+	if c.Speedup < 0 {
+		return errors.New("speedup must be a positive number")
+	}
+	if c.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	if c.Amplify < 0 {
+		return errors.New("the number of copies must be a positive number")
+	}
+	if c.LateOpThreshold < 0 || c.MaxIdleGap < 0 || c.Warmup < 0 || c.WarmupOps < 0 || c.Duration < 0 ||
+		c.ShutdownTimeout < 0 || c.SlowOpThreshold < 0 || c.ReportInterval < 0 || c.OpDeadline < 0 {
+		return errors.New("durations and thresholds must not be negative")
+	}
+	if c.Retry == nil {
+		policy := DefaultRetryPolicy
+		c.Retry = &policy
+	} else if err := c.Retry.validate(); err != nil {
+		return err
+	}
+	for opType, maxTime := range c.MaxTime {
+		if maxTime < 0 {
+			return fmt.Errorf("the max time of %s ops must not be negative", opType)
+		}
+	}
+	for i := range c.Routes {
+		if err := c.Routes[i].validate(); err != nil {
+			return fmt.Errorf("route #%d: %v", i, err)
+		}
+	}
+	if err := c.WriteConcern.validate(); err != nil {
+		return err
+	}
+	for namespace, writeConcern := range c.WriteConcernByNamespace {
+		if err := writeConcern.validate(); err != nil {
+			return fmt.Errorf("write concern of %s: %v", namespace, err)
+		}
+	}
+	readConcerns := []string{c.ReadConcern}
+	for _, level := range c.ReadConcernByNamespace {
+		readConcerns = append(readConcerns, level)
+	}
+	for _, level := range readConcerns {
+		if level == "" {
+			continue
+		}
+		if !validReadConcern(level) {
+			return fmt.Errorf("unknown read concern level %q", level)
+		}
+		for _, node := range c.Nodes {
+			if node.Driver != MongoGoDriver {
+				return fmt.Errorf("node %s can't send a read concern, only the %s driver can", node.Name,
+					MongoGoDriver)
+			}
+		}
+	}
+	for opType, threshold := range c.SlowOpThresholdByType {
+		if threshold < 0 {
+			return fmt.Errorf("the slow op threshold of %s ops must not be negative", opType)
+		}
+	}
+	for namespace, threshold := range c.SlowOpThresholdByNamespace {
+		if threshold < 0 {
+			return fmt.Errorf("the slow op threshold of %s must not be negative", namespace)
+		}
+	}
+
+	if c.MaxOps == 0 {
+		c.MaxOps = math.MaxUint32
+	}
+	if c.Speedup == 0 {
+		c.Speedup = 1.0
+	}
+	if c.LateOpPolicy == "" {
+		c.LateOpPolicy = LateOpContinue
+	}
+	if c.Amplify == 0 {
+		c.Amplify = 1
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if c.ReportInterval == 0 {
+		c.ReportInterval = defaultReportInterval
+	}
+	return nil
+}
+
+// slowOpThreshold is how long op may take before it is logged as slow, 0 if
+// it never is
+func (c *ReplayConfig) slowOpThreshold(op *Op) time.Duration {
+	if threshold, ok := c.SlowOpThresholdByNamespace[op.Database+"."+op.Collection]; ok {
+		return threshold
+	}
+	if threshold, ok := c.SlowOpThresholdByType[op.Type]; ok {
+		return threshold
+	}
+	return c.SlowOpThreshold
+}
+
+// setConcerns picks the write concern of op if it's a write, or its read
+// concern if it's a read
+func (c *ReplayConfig) setConcerns(op *Op) {
+	op.WriteConcern, op.ReadConcern = WriteConcern{}, ""
+	namespace := op.Database + "." + op.Collection
+	switch op.Type {
+	case Insert, Update, Remove, FindAndModify:
+		if recorded, ok := recordedWriteConcern(op); ok && c.HonorRecordedWriteConcern {
+			op.WriteConcern = recorded
+		} else if writeConcern, ok := c.WriteConcernByNamespace[namespace]; ok {
+			op.WriteConcern = writeConcern
+		} else {
+			op.WriteConcern = c.WriteConcern
+		}
+	case Query, Count:
+		if level, ok := c.ReadConcernByNamespace[namespace]; ok {
+			op.ReadConcern = level
+		} else {
+			op.ReadConcern = c.ReadConcern
+		}
+	}
+}
+
+type replayNode struct {
+	config        NodeConfig
+	backends      BackendPool
+	schedule      *ReplaySchedule
+	statsFile     *os.File
+	statsChan     chan OpStat
+	statsAnalyzer *StatsAnalyzer
+	// one per copy of the ops, only when they are amplified
+	copyStatsAnalyzers []*StatsAnalyzer
+}
+
+// pipeline feeds the ops to some nodes: to all of them in lock-step, or to a
+// single one with independent pipelines
+type pipeline struct {
+	nodes []*replayNode
+	// the ops, or a fan-out branch of them
+	reader         OpsReader
+	schedule       *ReplaySchedule
+	workerOpsChans []chan *Op
+	pool           *workerPool
+}
+
+type nodeWorkerState struct {
+	name    string
+	backend ExecutorBackend
+	exec    *OpsExecutor
+}
+
+// Replayer replays recorded ops against one or more nodes, and keeps track of
+// how they perform. It is what cmd/flashback runs, and can be embedded to
+// replay ops from other programs, i.e. integration tests.
+type Replayer struct {
+	config  ReplayConfig
+	logger  *Logger
+	control *DispatchControl
+
+	nodes       []*replayNode
+	pipelines   []*pipeline
+	opsExecuted int64
+	// optional, where the mismatches are sampled
+	mismatches *mismatchLog
+	// optional, where the failed ops are written
+	failedOps *opLog
+	// optional, where the slow ops are written
+	slowOps *opLog
+	// the namespaces the ops touched, with CheckDivergence
+	namespaces  *namespaceSet
+	divergences []Divergence
+	// the query shapes of the ops, with ExplainFilename
+	shapes *shapeSet
+	plans  []ShapePlans
+
+	mutex     sync.Mutex
+	started   bool
+	stopCalls int
+	// closed by the first call to Stop
+	stopping chan struct{}
+	// closed by the second call to Stop
+	abandon chan struct{}
+	// closed once the replay is over
+	done chan struct{}
+	err  error
+}
+
+// NewReplayer checks the config and sets up a replayer. Nothing happens until
+// Start is called.
+func NewReplayer(config ReplayConfig, logger *Logger) (*Replayer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	r := &Replayer{
+		config:   config,
+		logger:   logger,
+		stopping: make(chan struct{}),
+		abandon:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if config.CheckDivergence {
+		r.namespaces = newNamespaceSet()
+	}
+	if config.ExplainFilename != "" {
+		r.shapes = newShapeSet()
+	}
+
+	// make sure the late op policy is valid
+	if _, err := r.newSchedule(); err != nil {
+		return nil, err
+	}
+	var err error
+	if r.control, err = NewDispatchControl(config.Speedup, config.Rate); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// DryRun goes through the ops that would be replayed, without connecting to
+// the nodes, and tells which ones would be executed, skipped or fail. The ops
+// are neither cycled through nor amplified.
+func (r *Replayer) DryRun() (*DryRunReport, error) {
+	reader, err := r.newReader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return DryRunOps(reader, r.config.MaxOps, r.logger)
+}
+
+// newSchedule keeps track of the lag of a "real" style replay. There is one
+// per pipeline.
+func (r *Replayer) newSchedule() (*ReplaySchedule, error) {
+	if r.config.Style != RealStyle {
+		return nil, nil
+	}
+	schedule, err := NewReplaySchedule(r.config.LateOpThreshold, r.config.LateOpPolicy)
+	if err != nil {
+		return nil, err
+	}
+	schedule.MaxIdleGap = r.config.MaxIdleGap
+	return schedule, nil
+}
+
+// Control lets the pace of the replay be changed while it is running
+func (r *Replayer) Control() *DispatchControl {
+	return r.control
+}
+
+// Start connects to the nodes and starts replaying the ops in the background
+func (r *Replayer) Start() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.started {
+		return errors.New("the replayer was already started")
+	}
+
+	var concurrency *TraceConcurrency
+	if r.config.EmulateConcurrency != "" {
+		var err error
+		if concurrency, err = r.scanConcurrency(); err != nil {
+			return err
+		}
+		if r.config.EmulateConcurrency == ConcurrencyFromClients {
+			r.config.Workers = len(concurrency.Clients)
+		} else {
+			r.config.Workers = concurrency.MaxOverlap
+		}
+		if r.config.Workers == 0 {
+			return errors.New("unable to infer the concurrency from the ops")
+		}
+		r.logger.Infof("Emulating recorded concurrency with %d workers", r.config.Workers)
+	}
+
+	if r.config.MismatchFilename != "" {
+		var err error
+		if r.mismatches, err = newMismatchLog(r.config.MismatchFilename, r.config.MaxMismatchSamples); err != nil {
+			return err
+		}
+	}
+	if r.config.FailedOpsFilename != "" {
+		var err error
+		if r.failedOps, err = newOpLog(r.config.FailedOpsFilename); err != nil {
+			r.closeNodes()
+			return err
+		}
+	}
+	if r.config.SlowOpsFilename != "" {
+		var err error
+		if r.slowOps, err = newOpLog(r.config.SlowOpsFilename); err != nil {
+			r.closeNodes()
+			return err
+		}
+	}
+	if err := r.createPipelines(); err != nil {
+		r.closeNodes()
+		return err
+	}
+
+	// Hand each worker its own ops if the clients' order has to be preserved
+	for _, p := range r.pipelines {
+		opsChan := p.workerOpsChans[0]
+		if r.config.EmulateConcurrency == ConcurrencyFromClients {
+			p.workerOpsChans = AssignOpsToClients(opsChan, concurrency.Clients)
+		} else if r.config.PreserveClientOrder {
+			p.workerOpsChans = ShardOpsByClient(opsChan, r.config.Workers)
+		}
+	}
+
+	for _, p := range r.pipelines {
+		// workers can only come and go when they share the ops
+		p := p
+		p.pool = newWorkerPool(r.config.Workers, len(p.workerOpsChans) == 1, func(id int, quit chan struct{}) {
+			r.work(p, id, quit)
+		})
+	}
+	r.started = true
+	go r.run()
+	return nil
+}
+
+// createPipelines connects to the nodes, and gets the ops flowing to them
+func (r *Replayer) createPipelines() error {
+	reader, err := r.openOps()
+	if err != nil {
+		return err
+	}
+
+	if r.config.Pipeline == LockStepPipeline {
+		p := &pipeline{reader: reader}
+		if p.schedule, err = r.newSchedule(); err != nil {
+			reader.Close()
+			return err
+		}
+		for _, nodeConfig := range r.config.Nodes {
+			n, err := r.createNode(nodeConfig, p.schedule)
+			if err != nil {
+				reader.Close()
+				return err
+			}
+			r.nodes = append(r.nodes, n)
+		}
+		p.nodes = r.nodes
+		p.workerOpsChans = []chan *Op{r.dispatch(p.reader, p.schedule)}
+		r.pipelines = []*pipeline{p}
+		return nil
+	}
+
+	branches := NewFanOutOpsReaders(reader, len(r.config.Nodes), fanOutBufferSize)
+	closeBranches := func() {
+		for _, branch := range branches {
+			branch.Close()
+		}
+	}
+	for i, nodeConfig := range r.config.Nodes {
+		p := &pipeline{reader: branches[i]}
+		if p.schedule, err = r.newSchedule(); err != nil {
+			closeBranches()
+			return err
+		}
+		n, err := r.createNode(nodeConfig, p.schedule)
+		if err != nil {
+			closeBranches()
+			return err
+		}
+		r.nodes = append(r.nodes, n)
+		p.nodes = []*replayNode{n}
+		r.pipelines = append(r.pipelines, p)
+	}
+
+	// The "stress" dispatcher loads all the ops before it returns, so the
+	// dispatchers have to read their branches at the same time
+	var wg sync.WaitGroup
+	for _, p := range r.pipelines {
+		wg.Add(1)
+		go func(p *pipeline) {
+			defer wg.Done()
+			p.workerOpsChans = []chan *Op{r.dispatch(p.reader, p.schedule)}
+		}(p)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Stop stops dispatching ops, and gives the in-flight ones ShutdownTimeout to
+// finish. Calling it again stops waiting for them. It doesn't block, use Wait
+// for the replay to be over.
+func (r *Replayer) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stopCalls++
+	switch r.stopCalls {
+	case 1:
+		close(r.stopping)
+	case 2:
+		close(r.abandon)
+	}
+}
+
+// Wait blocks until the replay is over and the final report is done. It
+// returns ErrReplayAborted if the ops fell too far behind schedule under
+// LateOpAbort.
+func (r *Replayer) Wait() error {
+	<-r.done
+	return r.err
+}
+
+// Status returns the current stats of each node, keyed by node name. Copies
+// of amplified ops are keyed as "<node>/copyN". It doesn't start a new report
+// interval.
+func (r *Replayer) Status() map[string]*ExecutionStatus {
+	statuses := make(map[string]*ExecutionStatus)
+	r.eachAnalyzer(func(name string, analyzer *StatsAnalyzer, _ *os.File) {
+		statuses[name] = analyzer.CurrentStatus()
+	})
+	return statuses
+}
+
+// OpsExecuted is the number of ops that went through all the nodes, or
+// through the reference node with independent pipelines
+func (r *Replayer) OpsExecuted() int64 {
+	return atomic.LoadInt64(&r.opsExecuted)
+}
+
+// Workers is the number of running workers, per node with independent
+// pipelines
+func (r *Replayer) Workers() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.pipelines) == 0 {
+		return 0
+	}
+	return r.pipelines[0].pool.size()
+}
+
+// SetWorkers starts or lets go workers until there are the given number of
+// them (per node with independent pipelines). The workers that are let go
+// finish their current op first.
+func (r *Replayer) SetWorkers(workers int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.pipelines) == 0 {
+		return errors.New("the replayer is not started")
+	}
+	for _, p := range r.pipelines {
+		if err := p.pool.resize(workers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) eachAnalyzer(f func(name string, analyzer *StatsAnalyzer, statsFile *os.File)) {
+	for _, n := range r.nodes {
+		f(n.config.Name, n.statsAnalyzer, n.statsFile)
+		for i, copyStatsAnalyzer := range n.copyStatsAnalyzers {
+			f(fmt.Sprintf("%s/copy%d", n.config.Name, i), copyStatsAnalyzer, nil)
+		}
+	}
+}
+
+// newReader opens the ops, and moves to the first one to replay
+func (r *Replayer) newReader() (OpsReader, error) {
+	var (
+		reader OpsReader
+		err    error
+	)
+	if r.config.NewOpsReader != nil {
+		reader, err = r.config.NewOpsReader()
+	} else {
+		err, reader = NewFileByLineOpsReader(r.config.OpsFilename, r.logger, r.config.OpFilter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.config.StartTime > 0 {
+		if _, err := reader.SetStartTime(r.config.StartTime); err != nil {
+			return nil, err
+		}
+	}
+	if r.config.NumSkipOps > 0 {
+		if err := reader.SkipOps(r.config.NumSkipOps); err != nil {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// mustNewReader is for the readers that are opened on the fly, once the ops
+// were already opened successfully
+func (r *Replayer) mustNewReader() OpsReader {
+	reader, err := r.newReader()
+	if err != nil {
+		panic(err)
+	}
+	return reader
+}
+
+// openOps opens the ops to replay, cycling through them or amplifying them
+// if need be
+func (r *Replayer) openOps() (OpsReader, error) {
+	makeReader := func() (OpsReader, error) {
+		if r.config.Style == RealStyle && r.config.Cyclic {
+			// make sure the ops can be read before cycling through them
+			reader, err := r.newReader()
+			if err != nil {
+				return nil, err
+			}
+			reader.Close()
+			return NewCyclicOpsReader(r.mustNewReader, r.logger), nil
+		}
+		return r.newReader()
+	}
+
+	reader, err := makeReader()
+	if err != nil {
+		return nil, err
+	}
+	if r.config.Amplify > 1 {
+		reader.Close()
+		amplified, err := NewAmplifiedOpsReader(makeReader, r.config.Amplify, r.config.AmplifyOffset,
+			r.config.AmplifyRewriteKeys, r.logger)
+		if err != nil {
+			return nil, err
+		}
+		reader = amplified
+	}
+	return reader, nil
+}
+
+func (r *Replayer) dispatch(reader OpsReader, schedule *ReplaySchedule) chan *Op {
+	if r.config.Style == StressStyle {
+		return NewBestEffortOpsDispatcher(reader, r.config.MaxOps, r.logger, r.control)
+	}
+	return NewByTimeOpsDispatcher(reader, r.config.MaxOps, r.logger, r.config.Speedup, schedule, r.control)
+}
+
+// scanConcurrency goes through the ops that are going to be replayed, to find
+// out how many clients were active when they were recorded.
+func (r *Replayer) scanConcurrency() (*TraceConcurrency, error) {
+	reader, err := r.newReader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	concurrency := ScanTraceConcurrency(reader, r.config.MaxOps)
+	r.logger.Infof("Found %d clients (%d ops without a client), at most %d ops running at the same time",
+		len(concurrency.Clients), concurrency.OpsWithoutClient, concurrency.MaxOverlap)
+	return concurrency, nil
+}
+
+func (r *Replayer) createNode(config NodeConfig, schedule *ReplaySchedule) (*replayNode, error) {
+	n := &replayNode{config: config, schedule: schedule}
+
+	var err error
+	if n.backends, err = DialBackend(config); err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %s", config.Name, err)
+	}
+
+	if config.StatsFilename != "" {
+		if n.statsFile, err = os.Create(config.StatsFilename); err != nil {
+			n.backends.Close()
+			return nil, err
+		}
+	}
+
+	workers := r.config.Workers
+	n.statsChan = make(chan OpStat, workers*100)
+	if r.config.Amplify > 1 {
+		// track each copy on its own, on top of the combined stats
+		combinedChan := make(chan OpStat, workers*100)
+		copyChans := make([]chan OpStat, r.config.Amplify)
+		for i := range copyChans {
+			copyChans[i] = make(chan OpStat, workers*100)
+			n.copyStatsAnalyzers = append(n.copyStatsAnalyzers, NewStatsAnalyzer(copyChans[i]))
+		}
+		go func(statsChan chan OpStat) {
+			for stat := range statsChan {
+				combinedChan <- stat
+				copyChans[stat.Copy] <- stat
+			}
+			close(combinedChan)
+			for _, copyChan := range copyChans {
+				close(copyChan)
+			}
+		}(n.statsChan)
+		n.statsAnalyzer = NewStatsAnalyzer(combinedChan)
+	} else {
+		n.statsAnalyzer = NewStatsAnalyzer(n.statsChan)
+	}
+	n.statsAnalyzer.SetWarmup(r.config.Warmup, r.config.WarmupOps)
+	for _, copyStatsAnalyzer := range n.copyStatsAnalyzers {
+		// each copy gets its share of the ops
+		copyStatsAnalyzer.SetWarmup(r.config.Warmup, r.config.WarmupOps/int64(r.config.Amplify))
+	}
+	if schedule != nil {
+		n.statsAnalyzer.SetReplaySchedule(schedule)
+		for _, copyStatsAnalyzer := range n.copyStatsAnalyzers {
+			copyStatsAnalyzer.SetReplaySchedule(schedule)
+		}
+	}
+	return n, nil
+}
+
+func (r *Replayer) closeNodes() {
+	if r.mismatches != nil {
+		r.mismatches.close()
+	}
+	if r.failedOps != nil {
+		r.failedOps.close()
+	}
+	if r.slowOps != nil {
+		r.slowOps.close()
+	}
+	for _, n := range r.nodes {
+		n.backends.Close()
+		if n.statsFile != nil {
+			n.statsFile.Close()
+		}
+	}
+}
+
+// work runs ops on all the nodes of a pipeline, one op at a time, until there
+// are no more ops or it is told to quit
+func (r *Replayer) work(p *pipeline, id int, quit chan struct{}) {
+	r.logger.Infof("Worker #%d report for duty\n", id)
+	opsChan := p.workerOpsChans[id%len(p.workerOpsChans)]
+	// with independent pipelines, only the reference node counts the ops
+	countOps := p.nodes[0] == r.nodes[0]
+
+	var namespaces *namespaceSet
+	if r.namespaces != nil {
+		namespaces = newNamespaceSet()
+		defer r.namespaces.merge(namespaces)
+	}
+	var shapes *shapeSet
+	if r.shapes != nil {
+		shapes = newShapeSet()
+		defer r.shapes.merge(shapes)
+	}
+
+	workerStates := make([]nodeWorkerState, len(p.nodes))
+	for i, n := range p.nodes {
+		backend := n.backends.Get()
+		defer backend.Close()
+		workerStates[i] = nodeWorkerState{
+			name:    n.config.Name,
+			backend: backend,
+			exec:    NewBackendOpsExecutor(backend, n.statsChan, r.logger),
+		}
+		workerStates[i].exec.SetDeadline(r.config.OpDeadline)
+		workerStates[i].exec.SetRetryPolicy(*r.config.Retry)
+	}
+
+	for {
+		var op *Op
+		select {
+		case op = <-opsChan:
+		case <-quit:
+		}
+		// skip the ops that are still queued once the replay is stopped, and
+		// hold them while it's paused
+		if op == nil || r.control.holdOp(quit) {
+			break
+		}
+		op = CanonicalizeOp(op)
+		if op == nil {
+			continue
+		}
+		op.MaxTime = r.config.MaxTime[op.Type]
+		routeOp(r.config.Routes, op)
+		r.config.setConcerns(op)
+		if namespaces != nil {
+			namespaces.add(op.Database, op.Collection)
+		}
+		if shapes != nil {
+			shapes.add(op)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(len(workerStates))
+		errs := make([]error, len(workerStates))
+		for i, ws := range workerStates {
+			go func(i int, ws nodeWorkerState) {
+				defer wg.Done()
+				if errs[i] = ws.exec.Execute(op); errs[i] != nil {
+					r.opError(ws.name, op, errs[i], ws.exec.LastLatency())
+				}
+			}(i, ws)
+		}
+		wg.Wait()
+
+		if r.config.Verifier != nil && r.config.Verifier.Verifies(op.Type) {
+			r.verify(p, op, workerStates, errs)
+		}
+
+		if threshold := r.config.slowOpThreshold(op); threshold > 0 {
+			r.checkSlowOp(op, threshold, workerStates)
+		}
+		if countOps {
+			atomic.AddInt64(&r.opsExecuted, 1)
+		}
+	}
+	r.logger.Infof("Worker #%d done!\n", id)
+}
+
+func (r *Replayer) opError(name string, op *Op, err error, latency time.Duration) {
+	if r.config.OnOpError != nil {
+		r.config.OnOpError(name, op, err)
+	}
+	if r.failedOps != nil {
+		if writeErr := r.failedOps.writeFailedOp(name, op, err, latency); writeErr != nil {
+			r.logger.Error(fmt.Sprintf("[%s] cannot write failed op: %v", name, writeErr))
+		}
+	}
+	if r.config.Verbose {
+		r.logger.Error(fmt.Sprintf(
+			"[%s] error executing op - type:%s,database:%s,collection:%s,error:%s", name,
+			op.Type, op.Database, op.Collection, err))
+	} else if strings.HasPrefix(err.Error(), "not authorized") {
+		r.logger.Error(fmt.Sprintf(
+			"[%s] not authorized to execute op - type:%s,database:%s", name, op.Type,
+			op.Database))
+		r.control.Stop()
+	}
+}
+
+// verify compares the results of the challengers to the ones of the reference
+// node. Ops that fail on both sides are not compared.
+func (r *Replayer) verify(p *pipeline, op *Op, workerStates []nodeWorkerState, errs []error) {
+	reference := workerStates[0]
+	for i := 1; i < len(workerStates); i++ {
+		ws := workerStates[i]
+		var diff string
+		switch {
+		case errs[0] != nil && errs[i] != nil:
+			continue
+		case errs[0] != nil:
+			diff = fmt.Sprintf("expected error %q, got a result", errs[0])
+		case errs[i] != nil:
+			diff = fmt.Sprintf("expected a result, got error %q", errs[i])
+		default:
+			diff = r.config.Verifier.Compare(reference.exec.LastResult(), ws.exec.LastResult())
+		}
+		if diff == "" {
+			continue
+		}
+
+		p.nodes[i].statsAnalyzer.RecordMismatch(op.Type)
+		if r.mismatches != nil {
+			r.mismatches.write(ws.name, reference.name, op, diff)
+		}
+		if r.config.OnMismatch != nil {
+			r.config.OnMismatch(ws.name, op, diff)
+		}
+	}
+}
+
+func (r *Replayer) checkSlowOp(op *Op, threshold time.Duration, workerStates []nodeWorkerState) {
+	wasAnyOpSlow := false
+	for _, ws := range workerStates {
+		if ws.exec.LastLatency() > threshold {
+			wasAnyOpSlow = true
+			break
+		}
+	}
+	if !wasAnyOpSlow {
+		return
+	}
+
+	var timeOutput string
+	latencies := make(map[string]time.Duration, len(workerStates))
+	for _, ws := range workerStates {
+		timeOutput = fmt.Sprintf("%s %v (%s)", timeOutput, ws.exec.LastLatency(), ws.name)
+		latencies[ws.name] = ws.exec.LastLatency()
+	}
+	r.logger.Infof(fmt.Sprintf("Slow op - %s\ntype:%s,database:%s,collection:%s",
+		timeOutput, op.Type, op.Database, op.Collection))
+	if r.slowOps != nil {
+		if err := r.slowOps.writeSlowOp(op, threshold, latencies); err != nil {
+			r.logger.Error(fmt.Sprintf("cannot write slow op: %v", err))
+		}
+	}
+	if r.config.OnSlowOp != nil {
+		r.config.OnSlowOp(op, latencies)
+	}
+}
+
+// run waits for the workers, or stops them gracefully once Stop is called or
+// the run duration is over, then reports one last time
+func (r *Replayer) run() {
+	defer close(r.done)
+	defer r.closeNodes()
+
+	reportTicker := time.NewTicker(r.config.ReportInterval)
+	stopReports, reportsDone := make(chan struct{}), make(chan struct{})
+	// Periodically report execution status
+	go func() {
+		defer close(reportsDone)
+		for {
+			select {
+			case <-reportTicker.C:
+				r.report()
+			case <-stopReports:
+				return
+			}
+		}
+	}()
+
+	workersDone := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, p := range r.pipelines {
+		wg.Add(1)
+		go func(p *pipeline) {
+			defer wg.Done()
+			p.pool.wait()
+			// let the other pipelines go on without this one
+			if branch, ok := p.reader.(*FanOutOpsReader); ok {
+				branch.Close()
+			}
+		}(p)
+	}
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+
+	// stop dispatching, and give the workers some time to finish their ops
+	stopGracefully := func() {
+		r.control.Stop()
+		select {
+		case <-workersDone:
+		case <-time.After(r.config.ShutdownTimeout):
+			r.logger.Errorf("Workers did not finish their ops within %v", r.config.ShutdownTimeout)
+		case <-r.abandon:
+			r.logger.Errorf("Not waiting for in-flight ops")
+		}
+	}
+
+	var deadline <-chan time.Time
+	if r.config.Duration > 0 {
+		deadline = time.After(r.config.Duration)
+	}
+
+	select {
+	case <-workersDone:
+	case <-r.stopping:
+		r.logger.Infof("Stopping, waiting up to %v for in-flight ops to finish", r.config.ShutdownTimeout)
+		stopGracefully()
+	case <-deadline:
+		r.logger.Infof("Ran for %v, waiting up to %v for in-flight ops to finish",
+			r.config.Duration, r.config.ShutdownTimeout)
+		stopGracefully()
+	}
+	// the final report must not run alongside a periodic one
+	reportTicker.Stop()
+	close(stopReports)
+	<-reportsDone
+	r.eachAnalyzer(func(_ string, analyzer *StatsAnalyzer, _ *os.File) {
+		analyzer.StopClock()
+	})
+
+	// make sure the stats of every executed op are accounted for, unless some
+	// workers may still be running
+	finished := false
+	select {
+	case <-workersDone:
+		finished = true
+		for _, n := range r.nodes {
+			close(n.statsChan)
+		}
+		r.eachAnalyzer(func(_ string, analyzer *StatsAnalyzer, _ *os.File) {
+			<-analyzer.Done()
+		})
+	default:
+	}
+	// report one last time
+	r.report()
+
+	if r.config.CheckDivergence {
+		if finished {
+			r.checkDivergence()
+		} else {
+			r.logger.Errorf("Not checking the data for divergence, some ops may still be running")
+		}
+	}
+	if r.shapes != nil {
+		r.explainPlans()
+	}
+
+	for _, n := range r.nodes {
+		if n.schedule != nil && n.schedule.Aborted() {
+			r.logger.Error(ErrReplayAborted.Error())
+			r.err = ErrReplayAborted
+			break
+		}
+	}
+}
+
+// checkDivergence compares the data of the nodes once all the ops are done
+func (r *Replayer) checkDivergence() {
+	r.logger.Infof("Checking the touched collections for divergence")
+	names := make([]string, len(r.nodes))
+	backends := make([]ExecutorBackend, len(r.nodes))
+	for i, n := range r.nodes {
+		names[i] = n.config.Name
+		backends[i] = n.backends.Get()
+		defer backends[i].Close()
+	}
+
+	divergences, err := findDivergences(names, backends, r.namespaces, r.config.MaxDivergenceSampleIds)
+	if err != nil {
+		r.logger.Errorf("Failed to check for divergence: %v", err)
+	}
+	for _, d := range divergences {
+		r.logger.Error(d.String())
+	}
+	if err == nil && len(divergences) == 0 {
+		r.logger.Infof("No divergence found")
+	}
+	r.mutex.Lock()
+	r.divergences = divergences
+	r.mutex.Unlock()
+}
+
+// explainPlans explains every query shape on every node, and writes the plans
+// to ExplainFilename
+func (r *Replayer) explainPlans() {
+	r.logger.Infof("Explaining the query shapes")
+	names := make([]string, len(r.nodes))
+	backends := make([]ExecutorBackend, len(r.nodes))
+	for i, n := range r.nodes {
+		names[i] = n.config.Name
+		backends[i] = n.backends.Get()
+		defer backends[i].Close()
+	}
+
+	plans := explainShapes(names, backends, r.shapes)
+	differing := 0
+	for _, shape := range plans {
+		if shape.Differs {
+			differing++
+			r.logger.Errorf("The plan of %s %s %s differs between nodes", shape.Type, shape.Namespace, shape.Shape)
+		}
+	}
+	r.logger.Infof("Explained %d query shapes, %d of them have differing plans", len(plans), differing)
+
+	file, err := os.Create(r.config.ExplainFilename)
+	if err != nil {
+		r.logger.Errorf("Failed to write the plans: %v", err)
+	} else {
+		writePlans(file, plans)
+		file.Close()
+	}
+	r.mutex.Lock()
+	r.plans = plans
+	r.mutex.Unlock()
+}
+
+// Plans returns the plans of every query shape on every node once the replay
+// is over, with ExplainFilename
+func (r *Replayer) Plans() []ShapePlans {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.plans
+}
+
+// Divergences returns the collections whose data differed once the replay was
+// over, with CheckDivergence
+func (r *Replayer) Divergences() []Divergence {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.divergences
+}
+
+func (r *Replayer) report() {
+	r.eachAnalyzer(func(name string, analyzer *StatsAnalyzer, statsFile *os.File) {
+		status := analyzer.GetStatus()
+		r.printStatus(status, statsFile, name)
+		if r.config.OnReport != nil {
+			r.config.OnReport(name, status)
+		}
+	})
+}
+
+// formatErrorCounts lists the categories that have errors, i.e.
+// "network: 3, not_primary: 1", or "none"
+func formatErrorCounts(counts map[ErrorCategory]int64) string {
+	var parts []string
+	for _, category := range AllErrorCategories {
+		if counts[category] > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d", category, counts[category]))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r *Replayer) printStatus(status *ExecutionStatus, statsOut *os.File, name string) {
+	r.logger.Infof("[%s] Executed %d ops (%d in interval), got %d errors (%d in interval) and %d timeouts "+
+		"(%d in interval), retried %d ops, %.2f ops/sec (total), %.2f ops/sec (interval)", name,
+		status.OpsExecuted, status.IntervalOpsExecuted, status.OpsErrors, status.IntervalOpsErrors,
+		status.OpsTimeouts, status.IntervalOpsTimeouts, status.Retries, status.OpsPerSec,
+		status.IntervalOpsPerSec)
+	if status.InWarmup {
+		r.logger.Infof("[%s] Warming up: %d ops (%d errors) left out of the stats so far", name,
+			status.WarmupOpsExecuted, status.WarmupOpsErrors)
+	} else if status.WarmupOpsExecuted > 0 {
+		r.logger.Infof("[%s] %d ops (%d errors) executed during the warmup were left out of the stats", name,
+			status.WarmupOpsExecuted, status.WarmupOpsErrors)
+	}
+	if r.config.Style == RealStyle {
+		r.logger.Infof("[%s] Schedule lag: %v (max %v), %d late ops dropped, %v of idle time removed", name,
+			status.ScheduleLag, status.MaxScheduleLag, status.OpsDroppedLate, status.IdleTimeRemoved)
+	}
+
+	if r.config.Verifier != nil && status.Mismatches > 0 {
+		r.logger.Infof("[%s] %d results differ from the reference node (query: %d, count: %d, findAndModify: %d, "+
+			"update: %d, remove: %d)", name, status.Mismatches, status.MismatchCounts[Query],
+			status.MismatchCounts[Count], status.MismatchCounts[FindAndModify], status.MismatchCounts[Update],
+			status.MismatchCounts[Remove])
+	}
+
+	var statsLineOutput string
+	if statsOut != nil {
+		timestamp := time.Now().Format("2006-01-02 15:04:05 -0700")
+		statsLineOutput = fmt.Sprintf("%s,%d,%.2f", timestamp, status.IntervalOpsExecuted, status.IntervalOpsPerSec)
+	}
+
+	for _, opType := range AllOpTypes {
+		latencies := status.Latencies[opType]
+		intervalLatencies := status.IntervalLatencies[opType]
+		r.logger.Infof("  Op type: %s, count: %d, interval count %d, avg ops/sec: %.2f, interval ops/sec: %.2f, "+
+			"timeouts: %d", opType, status.Counts[opType], status.IntervalCounts[opType],
+			status.TypeOpsSec[opType], status.IntervalTypeOpsSec[opType], status.TimeoutCounts[opType])
+		template := "   %s: P50: %.2fms, P70: %.2fms, P90: %.2fms, P95 %.2fms, P99 %.2fms, Max %.2fms\n"
+		r.logger.Infof(template, "Total", latencies[P50], latencies[P70], latencies[P90],
+			latencies[P95], latencies[P99], status.MaxLatency[opType])
+		r.logger.Infof(template, "Interval", intervalLatencies[P50], intervalLatencies[P70],
+			intervalLatencies[P90], intervalLatencies[P95], intervalLatencies[P99],
+			status.IntervalMaxLatency[opType])
+		if errorCounts := formatErrorCounts(status.ErrorCounts[opType]); errorCounts != "none" ||
+			status.RetryCounts[opType] > 0 {
+			r.logger.Infof("   Errors: %s, retries: %d", errorCounts, status.RetryCounts[opType])
+		}
+		for _, summary := range status.Errors[opType] {
+			r.logger.Infof("     %s", summary)
+		}
+
+		if statsOut != nil {
+			statsLineOutput = fmt.Sprintf("%s,%d,%.2f", statsLineOutput,
+				status.IntervalCounts[opType], status.IntervalTypeOpsSec[opType])
+		}
+	}
+
+	// Write stats to disk at each interval for analysis later
+	// Format is:
+	// time,  ops, ops/sec, insert ops, inserts/sec, update ops, update/sec, remove ops, remove/sec,
+	// query ops, query/sec, count ops, count/sec, fam ops, fam/sec
+	if statsOut != nil {
+		statsOut.WriteString(statsLineOutput + "\n")
+	}
+}
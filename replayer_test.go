@@ -0,0 +1,161 @@
+package flashback
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestReplayConfigValidation(t *testing.T) {
+	t.Parallel()
+	valid := func() ReplayConfig {
+		return ReplayConfig{
+			Style:       StressStyle,
+			OpsFilename: "ops.bson",
+			Nodes:       []NodeConfig{{Name: "default"}},
+			Workers:     1,
+		}
+	}
+
+	config := valid()
+	ensure.Nil(t, config.validate())
+	ensure.DeepEqual(t, config.MaxOps, math.MaxUint32)
+	ensure.DeepEqual(t, config.Speedup, 1.0)
+	ensure.DeepEqual(t, config.LateOpPolicy, LateOpContinue)
+	ensure.DeepEqual(t, config.Amplify, 1)
+	ensure.DeepEqual(t, config.ShutdownTimeout, defaultShutdownTimeout)
+	ensure.DeepEqual(t, config.SocketTimeout, defaultSocketTimeout)
+	ensure.DeepEqual(t, config.ReportInterval, defaultReportInterval)
+	ensure.DeepEqual(t, config.MaxMismatchSamples, defaultMaxMismatchSamples)
+
+	invalid := []func(c *ReplayConfig){
+		func(c *ReplayConfig) { c.Style = "fast" },
+		func(c *ReplayConfig) { c.OpsFilename = "" },
+		func(c *ReplayConfig) { c.Nodes = nil },
+		func(c *ReplayConfig) { c.Nodes = []NodeConfig{{Name: ""}} },
+		func(c *ReplayConfig) { c.Nodes = []NodeConfig{{Name: "a"}, {Name: "a"}} },
+		func(c *ReplayConfig) { c.Workers = 0 },
+		func(c *ReplayConfig) { c.EmulateConcurrency = "threads" },
+		func(c *ReplayConfig) { c.Rate = -1 },
+		func(c *ReplayConfig) { c.Pipeline = "pipelined" },
+		func(c *ReplayConfig) { c.Verifier = &ResultVerifier{} },
+		func(c *ReplayConfig) { c.CheckDivergence = true },
+		func(c *ReplayConfig) { c.OpDeadline = -time.Second },
+		func(c *ReplayConfig) { c.MaxTime = map[OpType]time.Duration{Query: -time.Second} },
+		func(c *ReplayConfig) { c.Retry = &RetryPolicy{MaxAttempts: 0} },
+		func(c *ReplayConfig) { c.Routes = []RouteRule{{Type: Query}} },
+		func(c *ReplayConfig) { c.WriteConcern = WriteConcern{W: "0", J: true} },
+		func(c *ReplayConfig) { c.WriteConcernByNamespace = map[string]WriteConcern{"db.coll": {J: true}} },
+		func(c *ReplayConfig) { c.ReadConcern = "strong" },
+		// mgo can't send a read concern
+		func(c *ReplayConfig) { c.ReadConcernByNamespace = map[string]string{"db.coll": "majority"} },
+		func(c *ReplayConfig) { c.MaxDivergenceSampleIds = -1 },
+		func(c *ReplayConfig) { c.SlowOpThresholdByType = map[OpType]time.Duration{Query: -time.Second} },
+		func(c *ReplayConfig) {
+			c.SlowOpThresholdByNamespace = map[string]time.Duration{"db.coll": -time.Second}
+		},
+		func(c *ReplayConfig) {
+			c.Verifier = &ResultVerifier{}
+			c.Nodes = []NodeConfig{{Name: "a"}, {Name: "b"}}
+			c.Pipeline = IndependentPipelines
+		},
+		func(c *ReplayConfig) { c.Duration = -time.Second },
+		func(c *ReplayConfig) { c.Nodes = []NodeConfig{{Name: "a", Driver: "odbc"}} },
+		func(c *ReplayConfig) { c.Nodes = []NodeConfig{{Name: "a", PoolLimit: -1}} },
+	}
+	for _, change := range invalid {
+		config := valid()
+		change(&config)
+		ensure.NotNil(t, config.validate())
+	}
+
+	// nodes without their own socket timeout get the replay's one, without
+	// changing the caller's nodes
+	nodes := []NodeConfig{{Name: "default"}, {Name: "challenger", SocketTimeout: time.Second}}
+	config = valid()
+	config.Nodes = nodes
+	config.SocketTimeout = time.Minute
+	ensure.Nil(t, config.validate())
+	ensure.DeepEqual(t, config.Nodes[0].SocketTimeout, time.Minute)
+	ensure.DeepEqual(t, config.Nodes[1].SocketTimeout, time.Second)
+	ensure.DeepEqual(t, nodes[0].SocketTimeout, time.Duration(0))
+
+	// the number of workers can come from the ops instead
+	config = valid()
+	config.Workers = 0
+	config.EmulateConcurrency = ConcurrencyFromOverlap
+	ensure.Nil(t, config.validate())
+}
+
+func TestSlowOpThreshold(t *testing.T) {
+	t.Parallel()
+
+	config := ReplayConfig{
+		SlowOpThreshold:            time.Second,
+		SlowOpThresholdByType:      map[OpType]time.Duration{Query: 100 * time.Millisecond, Insert: 0},
+		SlowOpThresholdByNamespace: map[string]time.Duration{"db.users": 10 * time.Millisecond},
+	}
+	ensure.DeepEqual(t, config.slowOpThreshold(&Op{Type: Update, Database: "db", Collection: "coll"}), time.Second)
+	ensure.DeepEqual(t, config.slowOpThreshold(&Op{Type: Query, Database: "db", Collection: "coll"}),
+		100*time.Millisecond)
+	ensure.DeepEqual(t, config.slowOpThreshold(&Op{Type: Insert, Database: "db", Collection: "coll"}),
+		time.Duration(0))
+	ensure.DeepEqual(t, config.slowOpThreshold(&Op{Type: Query, Database: "db", Collection: "users"}),
+		10*time.Millisecond)
+}
+
+func TestNewReplayer(t *testing.T) {
+	t.Parallel()
+	logger, _ := NewLogger("", "")
+
+	replayer, err := NewReplayer(ReplayConfig{
+		Style:        RealStyle,
+		NewOpsReader: func() (OpsReader, error) { return newSliceOpsReader(nil), nil },
+		Nodes:        []NodeConfig{{Name: "default"}},
+		Workers:      2,
+		Speedup:      2,
+		LateOpPolicy: LateOpDrop,
+	}, logger)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, replayer.Control().Speedup(), 2.0)
+	ensure.DeepEqual(t, replayer.config.Pipeline, LockStepPipeline)
+	schedule, err := replayer.newSchedule()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, schedule.Policy, LateOpDrop)
+	ensure.DeepEqual(t, replayer.Workers(), 0)
+	ensure.NotNil(t, replayer.SetWorkers(3))
+
+	_, err = NewReplayer(ReplayConfig{Style: RealStyle}, logger)
+	ensure.NotNil(t, err)
+}
+
+func TestWorkerPool(t *testing.T) {
+	t.Parallel()
+
+	running := int32(0)
+	work := func(id int, quit chan struct{}) {
+		atomic.AddInt32(&running, 1)
+		<-quit
+		atomic.AddInt32(&running, -1)
+	}
+
+	pool := newWorkerPool(3, true, work)
+	ensure.DeepEqual(t, pool.size(), 3)
+	ensure.Nil(t, pool.resize(5))
+	ensure.DeepEqual(t, pool.size(), 5)
+	ensure.NotNil(t, pool.resize(0))
+	ensure.Nil(t, pool.resize(1))
+	ensure.DeepEqual(t, pool.size(), 1)
+
+	// let the last worker go too
+	pool.mutex.Lock()
+	close(pool.quits[0])
+	pool.mutex.Unlock()
+	pool.wait()
+	ensure.DeepEqual(t, atomic.LoadInt32(&running), int32(0))
+
+	ensure.NotNil(t, newWorkerPool(1, false, func(int, chan struct{}) {}).resize(2))
+}
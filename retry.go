@@ -0,0 +1,167 @@
+package flashback
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// ErrorCategory tells why an op failed, so that failovers can be told apart
+// from actual regressions
+type ErrorCategory string
+
+const (
+	NetworkError      ErrorCategory = "network"
+	TimeoutError      ErrorCategory = "timeout"
+	NotPrimaryError   ErrorCategory = "not_primary"
+	DuplicateKeyError ErrorCategory = "duplicate_key"
+	AuthError         ErrorCategory = "auth"
+	ServerError       ErrorCategory = "server"
+	// Errors that don't come from the node, i.e. invalid or unsupported ops,
+	// or updates that match no document
+	OtherError ErrorCategory = "other"
+)
+
+var AllErrorCategories = []ErrorCategory{
+	NetworkError, TimeoutError, NotPrimaryError, DuplicateKeyError, AuthError, ServerError, OtherError,
+}
+
+// The code of the errors of the ops that exceed their maxTimeMS
+const exceededTimeLimit = 50
+
+// The server error codes of each category
+var (
+	duplicateKeyCodes = []int{11000, 11001, 12582}
+	authCodes         = []int{13, 18}
+	// NotMaster, NotMasterNoSlaveOk, NotMasterOrSecondary, PrimarySteppedDown,
+	// ShutdownInProgress and InterruptedDueToReplStateChange
+	notPrimaryCodes = []int{10107, 13435, 13436, 189, 91, 11602}
+)
+
+// categoryOfServerError classifies the errors that come from the server. Old
+// servers only set a message for some of them.
+func categoryOfServerError(code int, message string) ErrorCategory {
+	if code == 0 {
+		switch {
+		case strings.HasPrefix(message, "not master"):
+			return NotPrimaryError
+		case strings.HasPrefix(message, "not authorized"):
+			return AuthError
+		case strings.HasPrefix(message, "E11000"):
+			return DuplicateKeyError
+		}
+	}
+
+	has := func(codes []int) bool {
+		for _, c := range codes {
+			if c == code {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case code == exceededTimeLimit:
+		return TimeoutError
+	case has(duplicateKeyCodes):
+		return DuplicateKeyError
+	case has(authCodes):
+		return AuthError
+	case has(notPrimaryCodes):
+		return NotPrimaryError
+	}
+	return ServerError
+}
+
+// RetryPolicy tells which failed ops are run again, and when
+type RetryPolicy struct {
+	// How many times an op runs at most, the first one included. 1 turns
+	// retries off.
+	MaxAttempts int
+	// How long to wait before the first retry, doubled after each of them up
+	// to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Randomizes the waits by up to this fraction of them, i.e. 0.2
+	Jitter float64
+	// The categories of errors that are worth retrying
+	RetryOn []ErrorCategory
+}
+
+// DefaultRetryPolicy retries network errors once, right away, like flashback
+// always did, as well as the errors of a failover. With mgo, the network
+// errors include "no reachable servers" and closed sockets, see
+// MgoBackend.Classify.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 2,
+	RetryOn:     []ErrorCategory{NetworkError, NotPrimaryError},
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("a retry policy needs at least one attempt")
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 || p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("the backoff must not be negative, and the jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+func (p *RetryPolicy) retries(category ErrorCategory) bool {
+	for _, c := range p.RetryOn {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff is how long to wait before a retry, the first one being #1
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < retry && wait > 0; i++ {
+		wait *= 2
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 && wait > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(wait))
+	}
+	return wait
+}
+
+// run runs block until it succeeds, fails with an error that isn't worth
+// retrying, runs out of attempts, or ctx is done. The backend is refreshed
+// before retrying the errors that come from broken connections or from a
+// failover.
+func (p *RetryPolicy) run(ctx context.Context, block func() error, backend ExecutorBackend) (retries int, err error) {
+	for {
+		err = block()
+		if err == nil || retries+1 >= p.MaxAttempts || ctx.Err() != nil {
+			return retries, err
+		}
+		category, _ := backend.Classify(err)
+		if !p.retries(category) {
+			return retries, err
+		}
+		if category == NetworkError || category == NotPrimaryError {
+			backend.Refresh()
+		}
+		if wait := p.backoff(retries + 1); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return retries, err
+			}
+		}
+		retries++
+	}
+}
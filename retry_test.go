@@ -0,0 +1,120 @@
+package flashback
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+// classifyingBackend tells the category of errors from their message, and
+// counts the refreshes
+type classifyingBackend struct {
+	ExecutorBackend
+	refreshes int
+}
+
+func (b *classifyingBackend) Classify(err error) (ErrorCategory, int) {
+	return ErrorCategory(err.Error()), 0
+}
+
+func (b *classifyingBackend) Refresh() {
+	b.refreshes++
+}
+
+func TestRetryPolicyRun(t *testing.T) {
+	t.Parallel()
+
+	failing := func(errs ...error) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		}, &calls
+	}
+	network, duplicateKey := errors.New(string(NetworkError)), errors.New(string(DuplicateKeyError))
+	policy := RetryPolicy{MaxAttempts: 3, RetryOn: []ErrorCategory{NetworkError, TimeoutError}}
+
+	// succeeds on the last attempt
+	backend := &classifyingBackend{}
+	block, calls := failing(network, network)
+	retries, err := policy.run(context.Background(), block, backend)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, retries, 2)
+	ensure.DeepEqual(t, *calls, 3)
+	ensure.DeepEqual(t, backend.refreshes, 2)
+
+	// runs out of attempts
+	backend = &classifyingBackend{}
+	block, calls = failing(network, network, network)
+	retries, err = policy.run(context.Background(), block, backend)
+	ensure.DeepEqual(t, err, network)
+	ensure.DeepEqual(t, retries, 2)
+	ensure.DeepEqual(t, *calls, 3)
+
+	// timeouts are retried on the same connections
+	backend = &classifyingBackend{}
+	block, _ = failing(errors.New(string(TimeoutError)))
+	retries, err = policy.run(context.Background(), block, backend)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, retries, 1)
+	ensure.DeepEqual(t, backend.refreshes, 0)
+
+	// not worth retrying
+	block, calls = failing(duplicateKey)
+	retries, err = policy.run(context.Background(), block, backend)
+	ensure.DeepEqual(t, err, duplicateKey)
+	ensure.DeepEqual(t, retries, 0)
+	ensure.DeepEqual(t, *calls, 1)
+
+	// gives up once the context is done, waiting for a retry included
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	block, calls = failing(network)
+	retries, err = policy.run(ctx, block, backend)
+	ensure.DeepEqual(t, err, network)
+	ensure.DeepEqual(t, retries, 0)
+	ensure.DeepEqual(t, *calls, 1)
+
+	slow := RetryPolicy{MaxAttempts: 3, Backoff: time.Hour, RetryOn: []ErrorCategory{NetworkError}}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	block, calls = failing(network)
+	retries, err = slow.run(ctx, block, backend)
+	ensure.DeepEqual(t, err, network)
+	ensure.DeepEqual(t, retries, 0)
+	ensure.DeepEqual(t, *calls, 1)
+
+	policy.MaxAttempts = 1
+	block, calls = failing(network)
+	retries, err = policy.run(context.Background(), block, backend)
+	ensure.DeepEqual(t, err, network)
+	ensure.DeepEqual(t, retries, 0)
+	ensure.DeepEqual(t, *calls, 1)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{MaxAttempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	ensure.DeepEqual(t, policy.backoff(1), 10*time.Millisecond)
+	ensure.DeepEqual(t, policy.backoff(2), 20*time.Millisecond)
+	ensure.DeepEqual(t, policy.backoff(3), 30*time.Millisecond)
+	ensure.DeepEqual(t, policy.backoff(10), 30*time.Millisecond)
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		wait := policy.backoff(1)
+		ensure.True(t, wait >= 5*time.Millisecond && wait <= 15*time.Millisecond, wait)
+	}
+
+	ensure.Nil(t, policy.validate())
+	ensure.NotNil(t, (&RetryPolicy{MaxAttempts: 0}).validate())
+	ensure.NotNil(t, (&RetryPolicy{MaxAttempts: 1, Jitter: 2}).validate())
+	ensure.NotNil(t, (&RetryPolicy{MaxAttempts: 1, Backoff: -time.Second}).validate())
+}
@@ -0,0 +1,149 @@
+package flashback
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ReadMode is a read preference mode, named as in the MongoDB drivers
+type ReadMode string
+
+const (
+	PrimaryMode            ReadMode = "primary"
+	PrimaryPreferredMode   ReadMode = "primaryPreferred"
+	SecondaryMode          ReadMode = "secondary"
+	SecondaryPreferredMode ReadMode = "secondaryPreferred"
+	NearestMode            ReadMode = "nearest"
+	// RecordedMode replays the reads with the read preference they were
+	// recorded with, see Op.ReadPreference
+	RecordedMode ReadMode = "recorded"
+)
+
+var readModes = []ReadMode{
+	PrimaryMode, PrimaryPreferredMode, SecondaryMode, SecondaryPreferredMode, NearestMode, RecordedMode,
+}
+
+// recordedReadPreference finds the mode of the $readPreference an op was
+// sent with, either in its command or in its wrapped query
+func recordedReadPreference(op *Op) ReadMode {
+	for _, doc := range []bson.D{op.CommandDoc, op.QueryDoc} {
+		pref, ok := GetElem(doc, "$readPreference")
+		if !ok {
+			continue
+		}
+		var mode interface{}
+		if d, ok := pref.(bson.D); ok {
+			mode, _ = GetElem(d, "mode")
+		} else if m, ok := asMap(pref); ok {
+			mode = m["mode"]
+		}
+		if mode, ok := mode.(string); ok {
+			return ReadMode(mode)
+		}
+	}
+	return ""
+}
+
+// RouteRule sends the ops it matches to a read preference mode, or to a
+// session of their own
+type RouteRule struct {
+	// What the rule matches, empty fields match any op
+	Type OpType
+	// "<database>.<collection>", or "<database>" for all its collections
+	Namespace string
+	// The host the op was recorded on, see Op.Host
+	Host string
+
+	// [Optional] The read preference mode of the matching queries and counts.
+	// The writes always go to the primary.
+	Mode ReadMode
+	// [Optional] Runs the matching ops on a session of their own, named
+	// after this, instead of the worker's one. Only with the mgo driver, the
+	// other one keeps a connection pool per host anyway.
+	Session string
+}
+
+func (r *RouteRule) validate() error {
+	if r.Mode == "" && r.Session == "" {
+		return errors.New("a route needs a mode or a session")
+	}
+	if r.Mode != "" && !validReadMode(r.Mode) {
+		return fmt.Errorf("unknown read mode %q", r.Mode)
+	}
+	return nil
+}
+
+func validReadMode(mode ReadMode) bool {
+	for _, m := range readModes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RouteRule) matches(op *Op) bool {
+	if r.Type != "" && r.Type != op.Type {
+		return false
+	}
+	if r.Namespace != "" && r.Namespace != op.Database &&
+		r.Namespace != op.Database+"."+op.Collection {
+		return false
+	}
+	return r.Host == "" || r.Host == op.Host
+}
+
+// routeOp decides where op is replayed, with the first rule that matches it
+func routeOp(rules []RouteRule, op *Op) {
+	op.ReadMode, op.Session = "", ""
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(op) {
+			continue
+		}
+		if op.Type == Query || op.Type == Count {
+			op.ReadMode = rule.Mode
+			if op.ReadMode == RecordedMode {
+				op.ReadMode = op.ReadPreference
+				if !validReadMode(op.ReadMode) {
+					op.ReadMode = ""
+				}
+			}
+		}
+		op.Session = rule.Session
+		return
+	}
+}
+
+var routeSettings = []string{"type", "namespace", "host", "mode", "session"}
+
+// ParseRouteRule parses a rule from a comma separated list of settings, i.e.
+// "type=query,namespace=db.users,host=db2:27017,mode=secondary"
+func ParseRouteRule(value string) (RouteRule, error) {
+	var r RouteRule
+	for _, setting := range strings.Split(value, ",") {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("route setting %q should look like key=value", setting)
+		}
+		switch kv[0] {
+		case "type":
+			r.Type = OpType(kv[1])
+		case "namespace":
+			r.Namespace = kv[1]
+		case "host":
+			r.Host = kv[1]
+		case "mode":
+			r.Mode = ReadMode(kv[1])
+		case "session":
+			r.Session = kv[1]
+		default:
+			return r, fmt.Errorf("unknown route setting %q, the only acceptable ones are %s", kv[0],
+				strings.Join(routeSettings, ", "))
+		}
+	}
+	return r, r.validate()
+}
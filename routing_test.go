@@ -0,0 +1,84 @@
+package flashback
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRecordedReadPreference(t *testing.T) {
+	t.Parallel()
+
+	query := &Op{Ns: "db.coll", Type: Query, QueryDoc: bson.D{
+		{"$query", bson.D{{"a", 1}}},
+		{"$readPreference", bson.D{{"mode", "secondaryPreferred"}}},
+	}}
+	normalizeOp(query)
+	ensure.DeepEqual(t, query.ReadPreference, SecondaryPreferredMode)
+
+	count := &Op{Ns: "db.$cmd", Type: Command, CommandDoc: bson.D{
+		{"count", "coll"},
+		{"$readPreference", bson.M{"mode": "nearest"}},
+	}}
+	normalizeOp(count)
+	ensure.DeepEqual(t, count.ReadPreference, NearestMode)
+
+	plain := &Op{Ns: "db.coll", Type: Query, QueryDoc: bson.D{{"a", 1}}}
+	normalizeOp(plain)
+	ensure.DeepEqual(t, plain.ReadPreference, ReadMode(""))
+}
+
+func TestRouteOp(t *testing.T) {
+	t.Parallel()
+
+	rules := []RouteRule{
+		{Host: "db2:27017", Mode: RecordedMode},
+		{Type: Query, Namespace: "db.users", Mode: SecondaryMode},
+		{Namespace: "reports", Mode: NearestMode, Session: "reports"},
+	}
+	route := func(op *Op) (ReadMode, string) {
+		routeOp(rules, op)
+		return op.ReadMode, op.Session
+	}
+
+	mode, session := route(&Op{Type: Query, Database: "db", Collection: "users"})
+	ensure.DeepEqual(t, mode, SecondaryMode)
+	ensure.DeepEqual(t, session, "")
+	mode, _ = route(&Op{Type: Count, Database: "db", Collection: "users"})
+	ensure.DeepEqual(t, mode, ReadMode(""))
+	mode, _ = route(&Op{Type: Query, Database: "db", Collection: "users", Host: "db2:27017",
+		ReadPreference: PrimaryPreferredMode})
+	ensure.DeepEqual(t, mode, PrimaryPreferredMode)
+	mode, _ = route(&Op{Type: Query, Database: "db", Collection: "users", Host: "db2:27017",
+		ReadPreference: "bogus"})
+	ensure.DeepEqual(t, mode, ReadMode(""))
+
+	// writes keep going to the primary, on their own session
+	mode, session = route(&Op{Type: Insert, Database: "reports", Collection: "daily"})
+	ensure.DeepEqual(t, mode, ReadMode(""))
+	ensure.DeepEqual(t, session, "reports")
+	mode, session = route(&Op{Type: Count, Database: "reports", Collection: "daily"})
+	ensure.DeepEqual(t, mode, NearestMode)
+	ensure.DeepEqual(t, session, "reports")
+
+	// a routed op that is replayed again is routed from scratch
+	op := &Op{Type: Query, Database: "db", Collection: "users"}
+	routeOp(rules, op)
+	routeOp(nil, op)
+	ensure.DeepEqual(t, op.ReadMode, ReadMode(""))
+}
+
+func TestParseRouteRule(t *testing.T) {
+	t.Parallel()
+
+	rule, err := ParseRouteRule("type=query,namespace=db.users,host=db2:27017,mode=secondary,session=reads")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, rule, RouteRule{Type: Query, Namespace: "db.users", Host: "db2:27017",
+		Mode: SecondaryMode, Session: "reads"})
+
+	for _, value := range []string{"type=query", "mode=secondary,colour=blue", "mode", "mode=secundary"} {
+		_, err = ParseRouteRule(value)
+		ensure.NotNil(t, err, value)
+	}
+}
@@ -1,7 +1,11 @@
 package flashback
 
 import (
+	"fmt"
 	"github.com/bmizerany/perks/quantile"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -10,12 +14,68 @@ type OpStat struct {
 	OpType  OpType
 	Latency time.Duration
 	OpError bool
+	// Why the op failed, if it did
+	ErrorCategory ErrorCategory
+	// The code of the server error, 0 if the error doesn't come from the
+	// server
+	ErrorCode    int
+	ErrorMessage string
+	// How many times the op was retried, see RetryPolicy
+	Retries int
+	// Which copy of the trace the op belongs to, see AmplifiedOpsReader
+	Copy int
 }
 
 var (
 	latencyPercentiles = []float64{0.5, 0.7, 0.9, 0.95, 0.99}
 )
 
+// How many distinct messages are kept for each kind of error
+const maxErrorSamples = 3
+
+// ErrorSummary counts the errors of an op type that share a category and a
+// code
+type ErrorSummary struct {
+	Category ErrorCategory
+	Code     int
+	Count    int64
+	// The first distinct messages of these errors
+	Samples []string
+}
+
+// String gives the count of these errors along with their samples
+func (e ErrorSummary) String() string {
+	msg := fmt.Sprintf("%s (code %d): %d", e.Category, e.Code, e.Count)
+	if len(e.Samples) > 0 {
+		quoted := make([]string, len(e.Samples))
+		for i, sample := range e.Samples {
+			quoted[i] = strconv.Quote(sample)
+		}
+		msg += ", i.e. " + strings.Join(quoted, ", ")
+	}
+	return msg
+}
+
+type errorKey struct {
+	category ErrorCategory
+	code     int
+}
+
+// errorSummaries sorts the most frequent errors first
+type errorSummaries []ErrorSummary
+
+func (e errorSummaries) Len() int      { return len(e) }
+func (e errorSummaries) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e errorSummaries) Less(i, j int) bool {
+	if e[i].Count != e[j].Count {
+		return e[i].Count > e[j].Count
+	}
+	if e[i].Category != e[j].Category {
+		return e[i].Category < e[j].Category
+	}
+	return e[i].Code < e[j].Code
+}
+
 // Percentiles
 const (
 	P50 = iota
@@ -29,33 +89,81 @@ type StatsAnalyzer struct {
 	statsChan chan OpStat
 
 	startTime   time.Time
+	endTime     time.Time
 	stream      map[OpType]*quantile.Stream
 	maxLatency  map[OpType]float64
 	opsExecuted int64
 	opsErrors   int64
+	opsTimeouts int64
 	counts      map[OpType]int64
+	timeouts    map[OpType]int64
+	opsRetries  int64
+	retries     map[OpType]int64
+	errorCounts map[OpType]map[ErrorCategory]int64
+	errors      map[OpType]map[errorKey]*ErrorSummary
 
 	intervalStartTime   time.Time
 	intervalStream      map[OpType]*quantile.Stream
 	intervalMaxLatency  map[OpType]float64
 	intervalOpsExecuted int64
 	intervalOpsErrors   int64
+	intervalOpsTimeouts int64
 	intervalCounts      map[OpType]int64
 
+	// ops whose result differs from the reference node's, see RecordMismatch
+	mismatches map[OpType]int64
+
+	// optional, only set when ops are replayed by time
+	schedule *ReplaySchedule
+
+	// ops executed during the warmup are only counted here, see SetWarmup
+	warmingUp         bool
+	warmupDuration    time.Duration
+	warmupOps         int64
+	warmupOpsExecuted int64
+	warmupOpsErrors   int64
+
+	// the clock, only replaced by the tests
+	now func() time.Time
+
 	mutex *sync.Mutex
+	done  chan struct{}
 }
 
 func (s *StatsAnalyzer) process(opStat OpStat) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if s.checkWarmup(s.now()) {
+		s.warmupOpsExecuted++
+		if opStat.OpError {
+			s.warmupOpsErrors++
+		}
+		return
+	}
+
 	s.counts[opStat.OpType]++
 	s.intervalCounts[opStat.OpType]++
 	s.opsExecuted++
 	s.intervalOpsExecuted++
+	s.opsRetries += int64(opStat.Retries)
+	s.retries[opStat.OpType] += int64(opStat.Retries)
 	if opStat.OpError == true {
-		s.opsErrors++
-		s.intervalOpsErrors++
+		category := opStat.ErrorCategory
+		if category == "" {
+			category = OtherError
+		}
+		s.errorCounts[opStat.OpType][category]++
+		s.addError(opStat, category)
+		// timeouts are counted apart from the other errors
+		if category == TimeoutError {
+			s.opsTimeouts++
+			s.intervalOpsTimeouts++
+			s.timeouts[opStat.OpType]++
+		} else {
+			s.opsErrors++
+			s.intervalOpsErrors++
+		}
 	}
 
 	latencyMs := float64(opStat.Latency) / float64(time.Millisecond)
@@ -70,12 +178,35 @@ func (s *StatsAnalyzer) process(opStat OpStat) {
 	}
 }
 
+func (s *StatsAnalyzer) addError(opStat OpStat, category ErrorCategory) {
+	key := errorKey{category, opStat.ErrorCode}
+	summary, ok := s.errors[opStat.OpType][key]
+	if !ok {
+		summary = &ErrorSummary{Category: category, Code: opStat.ErrorCode}
+		s.errors[opStat.OpType][key] = summary
+	}
+	summary.Count++
+	if len(summary.Samples) >= maxErrorSamples || opStat.ErrorMessage == "" {
+		return
+	}
+	for _, sample := range summary.Samples {
+		if sample == opStat.ErrorMessage {
+			return
+		}
+	}
+	summary.Samples = append(summary.Samples, opStat.ErrorMessage)
+}
+
 func NewStatsAnalyzer(statsChan chan OpStat) *StatsAnalyzer {
 	stream := make(map[OpType]*quantile.Stream)
 	intervalStream := make(map[OpType]*quantile.Stream)
+	errorCounts := make(map[OpType]map[ErrorCategory]int64)
+	errors := make(map[OpType]map[errorKey]*ErrorSummary)
 	for _, opType := range AllOpTypes {
 		stream[opType] = quantile.NewTargeted(0.5, 0.7, 0.9, 0.95, 0.99)
 		intervalStream[opType] = quantile.NewTargeted(0.5, 0.7, 0.9, 0.95, 0.99)
+		errorCounts[opType] = make(map[ErrorCategory]int64)
+		errors[opType] = make(map[errorKey]*ErrorSummary)
 	}
 	statsAnalyzer := &StatsAnalyzer{
 		statsChan:           statsChan,
@@ -85,13 +216,20 @@ func NewStatsAnalyzer(statsChan chan OpStat) *StatsAnalyzer {
 		opsExecuted:         0,
 		opsErrors:           0,
 		counts:              make(map[OpType]int64),
+		timeouts:            make(map[OpType]int64),
+		retries:             make(map[OpType]int64),
+		errorCounts:         errorCounts,
+		errors:              errors,
 		intervalStartTime:   time.Now(),
 		intervalStream:      intervalStream,
 		intervalMaxLatency:  make(map[OpType]float64),
 		intervalOpsExecuted: 0,
 		intervalOpsErrors:   0,
 		intervalCounts:      make(map[OpType]int64),
+		mismatches:          make(map[OpType]int64),
+		now:                 time.Now,
 		mutex:               &sync.Mutex{},
+		done:                make(chan struct{}),
 	}
 
 	go func() {
@@ -102,40 +240,135 @@ func NewStatsAnalyzer(statsChan chan OpStat) *StatsAnalyzer {
 			}
 			statsAnalyzer.process(op)
 		}
+		close(statsAnalyzer.done)
 	}()
 
 	return statsAnalyzer
 }
 
+// SetWarmup keeps the ops executed during the first duration, and the first
+// ops, out of the stats. If both are set, the warmup lasts until both are
+// reached. It must be called before any op stat is sent.
+func (s *StatsAnalyzer) SetWarmup(duration time.Duration, ops int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.warmupDuration = duration
+	s.warmupOps = ops
+	s.warmingUp = duration > 0 || ops > 0
+}
+
+// checkWarmup tells if we are still warming up. Once the warmup is over, the
+// stats start from scratch.
+func (s *StatsAnalyzer) checkWarmup(now time.Time) bool {
+	if !s.warmingUp {
+		return false
+	}
+	if s.warmupOpsExecuted < s.warmupOps || now.Sub(s.startTime) < s.warmupDuration {
+		return true
+	}
+
+	s.warmingUp = false
+	s.startTime = now
+	s.intervalStartTime = now
+	return false
+}
+
+// StopClock freezes the clock the ops/sec are computed with, so that a report
+// made once the replay is over only covers the actual run.
+func (s *StatsAnalyzer) StopClock() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.endTime = s.now()
+}
+
+// Done is closed once the stats channel is closed and all the op stats sent
+// to it are processed.
+func (s *StatsAnalyzer) Done() <-chan struct{} {
+	return s.done
+}
+
+// SetReplaySchedule makes the dispatcher's schedule lag and compressed idle
+// time part of the reported execution status.
+func (s *StatsAnalyzer) SetReplaySchedule(schedule *ReplaySchedule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.schedule = schedule
+}
+
+// RecordMismatch counts an op whose result differs from the one of the
+// reference node
+func (s *StatsAnalyzer) RecordMismatch(opType OpType) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.checkWarmup(s.now()) {
+		return
+	}
+	s.mismatches[opType]++
+}
+
 // ExecutionStatus encapsulates the aggregated information for the execution
 type ExecutionStatus struct {
 	OpsExecuted         int64
 	IntervalOpsExecuted int64
 	OpsErrors           int64
 	IntervalOpsErrors   int64
-	OpsPerSec           float64
-	IntervalOpsPerSec   float64
-	IntervalDuration    time.Duration
-	Latencies           map[OpType][]float64
-	IntervalLatencies   map[OpType][]float64
-	MaxLatency          map[OpType]float64
-	IntervalMaxLatency  map[OpType]float64
-	Counts              map[OpType]int64
-	IntervalCounts      map[OpType]int64
-	TypeOpsSec          map[OpType]float64
-	IntervalTypeOpsSec  map[OpType]float64
+	// Timeouts are not part of OpsErrors
+	OpsTimeouts         int64
+	IntervalOpsTimeouts int64
+	TimeoutCounts       map[OpType]int64
+	// The failed ops of each type, timeouts included, by category
+	ErrorCounts map[OpType]map[ErrorCategory]int64
+	// The failed ops of each type by category and code, the most frequent
+	// first
+	Errors             map[OpType][]ErrorSummary
+	Retries            int64
+	RetryCounts        map[OpType]int64
+	OpsPerSec          float64
+	IntervalOpsPerSec  float64
+	IntervalDuration   time.Duration
+	Latencies          map[OpType][]float64
+	IntervalLatencies  map[OpType][]float64
+	MaxLatency         map[OpType]float64
+	IntervalMaxLatency map[OpType]float64
+	Counts             map[OpType]int64
+	IntervalCounts     map[OpType]int64
+	TypeOpsSec         map[OpType]float64
+	IntervalTypeOpsSec map[OpType]float64
+	ScheduleLag        time.Duration
+	MaxScheduleLag     time.Duration
+	OpsDroppedLate     int64
+	IdleTimeRemoved    time.Duration
+	InWarmup           bool
+	WarmupOpsExecuted  int64
+	WarmupOpsErrors    int64
+	Mismatches         int64
+	MismatchCounts     map[OpType]int64
 }
 
+// GetStatus returns the execution status, and starts a new interval
 func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
+	return s.status(true)
+}
+
+// CurrentStatus is like GetStatus, without starting a new interval
+func (s *StatsAnalyzer) CurrentStatus() *ExecutionStatus {
+	return s.status(false)
+}
+
+func (s *StatsAnalyzer) status(resetInterval bool) *ExecutionStatus {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.checkWarmup(s.now())
 
 	opsExecuted := s.opsExecuted
 	intervalOpsExecuted := s.intervalOpsExecuted
 	opsErrors := s.opsErrors
 	intervalOpsErrors := s.intervalOpsErrors
 
-	now := time.Now()
+	now := s.now()
+	if !s.endTime.IsZero() {
+		now = s.endTime
+	}
 	durationSec := float64(now.Sub(s.startTime)) / float64(time.Second)
 	opsPerSec := float64(opsExecuted) / durationSec
 	intervalDuration := now.Sub(s.intervalStartTime)
@@ -150,6 +383,12 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	intervalTypeOpsSec := make(map[OpType]float64)
 	maxLatency := make(map[OpType]float64)
 	intervalMaxLatency := make(map[OpType]float64)
+	mismatchCounts := make(map[OpType]int64)
+	mismatches := int64(0)
+	timeoutCounts := make(map[OpType]int64)
+	retryCounts := make(map[OpType]int64)
+	errorCounts := make(map[OpType]map[ErrorCategory]int64)
+	errors := make(map[OpType][]ErrorSummary)
 
 	for _, opType := range AllOpTypes {
 		maxLatency[opType] = s.maxLatency[opType]
@@ -164,6 +403,20 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 
 		typeOpsSec[opType] = float64(s.counts[opType]) / durationSec
 		intervalTypeOpsSec[opType] = float64(s.intervalCounts[opType]) / intervalDurationSec
+		mismatchCounts[opType] = s.mismatches[opType]
+		timeoutCounts[opType] = s.timeouts[opType]
+		retryCounts[opType] = s.retries[opType]
+		errorCounts[opType] = make(map[ErrorCategory]int64)
+		for category, count := range s.errorCounts[opType] {
+			errorCounts[opType][category] = count
+		}
+		for _, summary := range s.errors[opType] {
+			copied := *summary
+			copied.Samples = append([]string(nil), summary.Samples...)
+			errors[opType] = append(errors[opType], copied)
+		}
+		sort.Sort(errorSummaries(errors[opType]))
+		mismatches += s.mismatches[opType]
 	}
 
 	status := ExecutionStatus{
@@ -171,6 +424,13 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		IntervalOpsExecuted: intervalOpsExecuted,
 		OpsErrors:           opsErrors,
 		IntervalOpsErrors:   intervalOpsErrors,
+		OpsTimeouts:         s.opsTimeouts,
+		IntervalOpsTimeouts: s.intervalOpsTimeouts,
+		TimeoutCounts:       timeoutCounts,
+		ErrorCounts:         errorCounts,
+		Errors:              errors,
+		Retries:             s.opsRetries,
+		RetryCounts:         retryCounts,
 		OpsPerSec:           opsPerSec,
 		IntervalOpsPerSec:   intervalOpsPerSec,
 		IntervalDuration:    intervalDuration,
@@ -182,6 +442,21 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 		IntervalCounts:      intervalCounts,
 		TypeOpsSec:          typeOpsSec,
 		IntervalTypeOpsSec:  intervalTypeOpsSec,
+		InWarmup:            s.warmingUp,
+		WarmupOpsExecuted:   s.warmupOpsExecuted,
+		WarmupOpsErrors:     s.warmupOpsErrors,
+		Mismatches:          mismatches,
+		MismatchCounts:      mismatchCounts,
+	}
+	if s.schedule != nil {
+		status.ScheduleLag = s.schedule.Lag()
+		status.MaxScheduleLag = s.schedule.MaxLag()
+		status.OpsDroppedLate = s.schedule.OpsDropped()
+		status.IdleTimeRemoved = s.schedule.IdleTimeRemoved()
+	}
+
+	if !resetInterval {
+		return &status
 	}
 
 	// reset interval
@@ -193,6 +468,7 @@ func (s *StatsAnalyzer) GetStatus() *ExecutionStatus {
 	}
 	s.intervalOpsExecuted = 0
 	s.intervalOpsErrors = 0
+	s.intervalOpsTimeouts = 0
 
 	return &status
 }
@@ -3,6 +3,7 @@ package flashback
 import (
 	"fmt"
 	"math"
+	"sync"
 	"testing"
 	"time"
 
@@ -22,7 +23,7 @@ func TestBasics(t *testing.T) {
 
 	for i := 0; i < 10; i += 1 {
 		for _, opType := range AllOpTypes {
-			statsChan <- OpStat{opType, time.Duration(i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(i) * time.Millisecond, OpError: false}
 		}
 	}
 	time.Sleep(100 * time.Millisecond)
@@ -56,10 +57,10 @@ func TestBasics(t *testing.T) {
 	// second interval
 	for i := 0; i < 10; i += 1 {
 		for _, opType := range AllOpTypes {
-			statsChan <- OpStat{opType, time.Duration(i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(i) * time.Millisecond, OpError: false}
 		}
 	}
-	statsChan <- OpStat{Insert, 0, true}
+	statsChan <- OpStat{OpType: Insert, Latency: 0, OpError: true}
 	time.Sleep(200 * time.Millisecond)
 
 	status = analyser.GetStatus()
@@ -90,7 +91,7 @@ func TestLatencies(t *testing.T) {
 	start := 1000
 	for _, opType := range AllOpTypes {
 		for i := 100; i >= 0; i-- {
-			statsChan <- OpStat{opType, time.Duration(start+i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(start+i) * time.Millisecond, OpError: false}
 		}
 		start += 2000
 	}
@@ -114,7 +115,7 @@ func TestLatencies(t *testing.T) {
 	start = 2000
 	for _, opType := range AllOpTypes {
 		for i := 100; i >= 0; i-- {
-			statsChan <- OpStat{opType, time.Duration(start+i) * time.Millisecond, false}
+			statsChan <- OpStat{OpType: opType, Latency: time.Duration(start+i) * time.Millisecond, OpError: false}
 		}
 		start += 2000
 	}
@@ -133,3 +134,251 @@ func TestLatencies(t *testing.T) {
 		start += 2000
 	}
 }
+
+func TestReplayScheduleInStatus(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.ScheduleLag, time.Duration(0))
+	ensure.DeepEqual(t, status.OpsDroppedLate, int64(0))
+
+	schedule, err := NewReplaySchedule(time.Second, LateOpDrop)
+	ensure.Nil(t, err)
+	schedule.update(3 * time.Second)
+	schedule.update(2 * time.Second)
+	schedule.opsDropped = 7
+	schedule.MaxIdleGap = time.Second
+	schedule.compressGap(time.Minute)
+	analyser.SetReplaySchedule(schedule)
+
+	status = analyser.GetStatus()
+	ensure.DeepEqual(t, status.ScheduleLag, 2*time.Second)
+	ensure.DeepEqual(t, status.MaxScheduleLag, 3*time.Second)
+	ensure.DeepEqual(t, status.OpsDroppedLate, int64(7))
+	ensure.DeepEqual(t, status.IdleTimeRemoved, 59*time.Second)
+}
+
+func TestDone(t *testing.T) {
+	statsChan := make(chan OpStat, 100)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	for i := 0; i < 100; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, OpError: false}
+	}
+	select {
+	case <-analyser.Done():
+		t.Fatal("done before the stats channel is closed")
+	default:
+	}
+	close(statsChan)
+	<-analyser.Done()
+	ensure.DeepEqual(t, analyser.GetStatus().OpsExecuted, int64(100))
+}
+
+func TestWarmupByOps(t *testing.T) {
+	statsChan := make(chan OpStat, 100)
+	analyser := NewStatsAnalyzer(statsChan)
+	analyser.SetWarmup(0, 5)
+
+	// slow and failing ops during the warmup don't show in the stats
+	for i := 0; i < 5; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Second, OpError: i%2 == 0}
+	}
+	for i := 0; i < 10; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, OpError: false}
+	}
+	close(statsChan)
+	<-analyser.Done()
+
+	status := analyser.GetStatus()
+	ensure.False(t, status.InWarmup)
+	ensure.DeepEqual(t, status.WarmupOpsExecuted, int64(5))
+	ensure.DeepEqual(t, status.WarmupOpsErrors, int64(3))
+	ensure.DeepEqual(t, status.OpsExecuted, int64(10))
+	ensure.DeepEqual(t, status.OpsErrors, int64(0))
+	ensure.DeepEqual(t, status.Counts[Query], int64(10))
+	ensure.DeepEqual(t, status.MaxLatency[Query], float64(1))
+	ensure.DeepEqual(t, status.Latencies[Query][P99], float64(1))
+}
+
+func TestWarmupByDuration(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	clock := useFakeClock(analyser)
+	analyser.SetWarmup(50*time.Millisecond, 0)
+
+	statsChan <- OpStat{OpType: Insert, Latency: time.Second, OpError: false}
+	status := analyser.GetStatus()
+	ensure.True(t, status.InWarmup)
+	ensure.DeepEqual(t, status.OpsExecuted, int64(0))
+
+	clock.advance(60 * time.Millisecond)
+	statsChan <- OpStat{OpType: Insert, Latency: time.Millisecond, OpError: false}
+	close(statsChan)
+	<-analyser.Done()
+	status = analyser.GetStatus()
+	ensure.False(t, status.InWarmup)
+	ensure.DeepEqual(t, status.WarmupOpsExecuted, int64(1))
+	ensure.DeepEqual(t, status.OpsExecuted, int64(1))
+	ensure.DeepEqual(t, status.MaxLatency[Insert], float64(1))
+}
+
+func TestStopClock(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+	clock := useFakeClock(analyser)
+
+	for i := 0; i < 10; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, OpError: false}
+	}
+	close(statsChan)
+	<-analyser.Done()
+	clock.advance(100 * time.Millisecond)
+	analyser.StopClock()
+	// time passing after the clock is stopped doesn't count
+	clock.advance(100 * time.Millisecond)
+	status := analyser.GetStatus()
+	floatEquals(status.OpsPerSec, 100.0, t)
+	floatEquals(status.IntervalOpsPerSec, 100.0, t)
+}
+
+func TestCurrentStatus(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	for i := 0; i < 10; i++ {
+		statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, OpError: false}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// peeking at the status doesn't start a new interval
+	ensure.DeepEqual(t, analyser.CurrentStatus().IntervalOpsExecuted, int64(10))
+	ensure.DeepEqual(t, analyser.CurrentStatus().IntervalOpsExecuted, int64(10))
+	ensure.DeepEqual(t, analyser.GetStatus().IntervalOpsExecuted, int64(10))
+	ensure.DeepEqual(t, analyser.CurrentStatus().IntervalOpsExecuted, int64(0))
+	ensure.DeepEqual(t, analyser.CurrentStatus().OpsExecuted, int64(10))
+}
+
+func TestTimeouts(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	statsChan <- OpStat{OpType: Query, Latency: time.Second, OpError: true, ErrorCategory: TimeoutError}
+	statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, OpError: true}
+	statsChan <- OpStat{OpType: Count, Latency: time.Second, OpError: true, ErrorCategory: TimeoutError}
+	statsChan <- OpStat{OpType: Count, Latency: time.Millisecond}
+	close(statsChan)
+	<-analyser.Done()
+
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.OpsExecuted, int64(4))
+	ensure.DeepEqual(t, status.OpsErrors, int64(1))
+	ensure.DeepEqual(t, status.OpsTimeouts, int64(2))
+	ensure.DeepEqual(t, status.IntervalOpsTimeouts, int64(2))
+	ensure.DeepEqual(t, status.TimeoutCounts[Query], int64(1))
+	ensure.DeepEqual(t, status.TimeoutCounts[Count], int64(1))
+
+	status = analyser.GetStatus()
+	ensure.DeepEqual(t, status.OpsTimeouts, int64(2))
+	ensure.DeepEqual(t, status.IntervalOpsTimeouts, int64(0))
+}
+
+func TestErrorCounts(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, OpError: true, ErrorCategory: NetworkError,
+		Retries: 1}
+	statsChan <- OpStat{OpType: Query, Latency: time.Millisecond, Retries: 2}
+	statsChan <- OpStat{OpType: Insert, Latency: time.Millisecond, OpError: true, ErrorCategory: DuplicateKeyError}
+	statsChan <- OpStat{OpType: Insert, Latency: time.Millisecond, OpError: true}
+	close(statsChan)
+	<-analyser.Done()
+
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.OpsErrors, int64(3))
+	ensure.DeepEqual(t, status.ErrorCounts[Query][NetworkError], int64(1))
+	ensure.DeepEqual(t, status.ErrorCounts[Insert][DuplicateKeyError], int64(1))
+	ensure.DeepEqual(t, status.ErrorCounts[Insert][OtherError], int64(1))
+	ensure.DeepEqual(t, status.Retries, int64(3))
+	ensure.DeepEqual(t, status.RetryCounts[Query], int64(3))
+	ensure.DeepEqual(t, status.RetryCounts[Insert], int64(0))
+}
+
+func TestErrorSummaries(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	duplicate := func(key int) OpStat {
+		return OpStat{OpType: Insert, OpError: true, ErrorCategory: DuplicateKeyError, ErrorCode: 11000,
+			ErrorMessage: fmt.Sprintf("E11000 duplicate key error, dup key: { _id: %d }", key)}
+	}
+	for i := 0; i < 5; i++ {
+		statsChan <- duplicate(i)
+	}
+	statsChan <- duplicate(0)
+	statsChan <- OpStat{OpType: Insert, OpError: true, ErrorCategory: ServerError, ErrorCode: 2,
+		ErrorMessage: "bad value"}
+	statsChan <- OpStat{OpType: Query, OpError: true, ErrorCategory: TimeoutError,
+		ErrorMessage: "op deadline exceeded"}
+	close(statsChan)
+	<-analyser.Done()
+
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.Errors[Insert], []ErrorSummary{
+		{Category: DuplicateKeyError, Code: 11000, Count: 6, Samples: []string{
+			"E11000 duplicate key error, dup key: { _id: 0 }",
+			"E11000 duplicate key error, dup key: { _id: 1 }",
+			"E11000 duplicate key error, dup key: { _id: 2 }",
+		}},
+		{Category: ServerError, Code: 2, Count: 1, Samples: []string{"bad value"}},
+	})
+	ensure.DeepEqual(t, status.Errors[Query][0].String(), `timeout (code 0): 1, i.e. "op deadline exceeded"`)
+	ensure.DeepEqual(t, len(status.Errors[Remove]), 0)
+}
+
+func TestRecordMismatch(t *testing.T) {
+	statsChan := make(chan OpStat)
+	analyser := NewStatsAnalyzer(statsChan)
+
+	analyser.RecordMismatch(Query)
+	analyser.RecordMismatch(Query)
+	analyser.RecordMismatch(Count)
+
+	status := analyser.GetStatus()
+	ensure.DeepEqual(t, status.Mismatches, int64(3))
+	ensure.DeepEqual(t, status.MismatchCounts[Query], int64(2))
+	ensure.DeepEqual(t, status.MismatchCounts[Count], int64(1))
+	ensure.DeepEqual(t, status.MismatchCounts[FindAndModify], int64(0))
+}
+
+// fakeClock only moves when it's told to
+type fakeClock struct {
+	mutex sync.Mutex
+	time  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.time = c.time.Add(d)
+}
+
+// useFakeClock makes the analyser, which must not have seen any op yet, run on a
+// fake clock
+func useFakeClock(s *StatsAnalyzer) *fakeClock {
+	clock := &fakeClock{time: time.Unix(1400000000, 0)}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.now = clock.now
+	s.startTime = clock.time
+	s.intervalStartTime = clock.time
+	return clock
+}
@@ -0,0 +1,91 @@
+package flashback
+
+import (
+	"sort"
+	"time"
+)
+
+// TraceConcurrency describes how many clients were talking to the database
+// while the ops were recorded. The clients are told apart by the profiler's
+// "client" field, which is the address of the client host rather than a
+// connection: all the connections of a host count as one client.
+type TraceConcurrency struct {
+	// Distinct clients, in order of their first op
+	Clients []string
+	// Ops that have no recorded client
+	OpsWithoutClient int
+	// The largest number of ops that were running at the same time, based on
+	// the ops' timestamps and recorded durations
+	MaxOverlap int
+}
+
+// ScanTraceConcurrency reads up to opsSize ops to figure out the concurrency
+// of the recorded workload. The reader is consumed, so it should not be the
+// one used for the replay.
+func ScanTraceConcurrency(reader OpsReader, opsSize int) *TraceConcurrency {
+	concurrency := &TraceConcurrency{}
+	seen := make(map[string]struct{})
+	var events concurrencyEvents
+
+	for i := 0; i < opsSize && !reader.AllLoaded(); i++ {
+		op := reader.Next()
+		if op == nil {
+			break
+		}
+
+		if op.Client == "" {
+			concurrency.OpsWithoutClient++
+		} else if _, ok := seen[op.Client]; !ok {
+			seen[op.Client] = struct{}{}
+			concurrency.Clients = append(concurrency.Clients, op.Client)
+		}
+
+		// An op is recorded by the profiler once it's done, so it was running
+		// from ts - millis to ts. The ops that took less than a millisecond
+		// only run at ts.
+		if op.Millis <= 0 {
+			events = append(events, concurrencyEvent{op.Timestamp, 0})
+			continue
+		}
+		start := op.Timestamp.Add(-time.Duration(op.Millis) * time.Millisecond)
+		events = append(events, concurrencyEvent{start, 1}, concurrencyEvent{op.Timestamp, -1})
+	}
+
+	sort.Sort(events)
+	running := 0
+	for _, e := range events {
+		running += e.delta
+		peak := running
+		if e.delta == 0 {
+			peak++
+		}
+		if peak > concurrency.MaxOverlap {
+			concurrency.MaxOverlap = peak
+		}
+	}
+
+	return concurrency
+}
+
+// concurrencyEvent marks an op starting (+1), ending (-1), or running for
+// less than a millisecond (0)
+type concurrencyEvent struct {
+	at    time.Time
+	delta int
+}
+
+type concurrencyEvents []concurrencyEvent
+
+func (e concurrencyEvents) Len() int      { return len(e) }
+func (e concurrencyEvents) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+// The ops run from their start up to, but not including, their end: an op
+// that starts at the very moment another one ends doesn't overlap it, hence
+// ends go first. Sub-millisecond ops that share a timestamp, i.e. the
+// sequential ops of a fast client, don't overlap each other either.
+func (e concurrencyEvents) Less(i, j int) bool {
+	if e[i].at.Equal(e[j].at) {
+		return e[i].delta < e[j].delta
+	}
+	return e[i].at.Before(e[j].at)
+}
@@ -0,0 +1,60 @@
+package flashback
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestScanTraceConcurrency(t *testing.T) {
+	t.Parallel()
+
+	epoch := time.Unix(testTime, 0)
+	at := func(ms int) time.Time {
+		return epoch.Add(time.Duration(ms) * time.Millisecond)
+	}
+	// timestamps mark the end of the ops:
+	//   a: 0-10, b: 5-15, c: 8-20, a: 30-30, <none>: 40-50
+	ops := []*Op{
+		{Ns: "db.coll", Type: Query, Timestamp: at(10), Millis: 10, Client: "a"},
+		{Ns: "db.coll", Type: Query, Timestamp: at(15), Millis: 10, Client: "b"},
+		{Ns: "db.coll", Type: Query, Timestamp: at(20), Millis: 12, Client: "c"},
+		{Ns: "db.coll", Type: Query, Timestamp: at(30), Client: "a"},
+		{Ns: "db.coll", Type: Query, Timestamp: at(50), Millis: 10},
+	}
+
+	concurrency := ScanTraceConcurrency(newSliceOpsReader(ops), len(ops))
+	ensure.DeepEqual(t, concurrency.Clients, []string{"a", "b", "c"})
+	ensure.DeepEqual(t, concurrency.OpsWithoutClient, 1)
+	ensure.DeepEqual(t, concurrency.MaxOverlap, 3)
+
+	// opsSize limits how far the trace is scanned
+	concurrency = ScanTraceConcurrency(newSliceOpsReader(ops), 2)
+	ensure.DeepEqual(t, concurrency.Clients, []string{"a", "b"})
+	ensure.DeepEqual(t, concurrency.MaxOverlap, 2)
+}
+
+func TestScanTraceConcurrencySameInstant(t *testing.T) {
+	t.Parallel()
+
+	// sub-millisecond ops that share a timestamp ran one after the other
+	ops := makeTimedOps(4, 0)
+	concurrency := ScanTraceConcurrency(newSliceOpsReader(ops), len(ops))
+	ensure.DeepEqual(t, len(concurrency.Clients), 0)
+	ensure.DeepEqual(t, concurrency.OpsWithoutClient, 4)
+	ensure.DeepEqual(t, concurrency.MaxOverlap, 1)
+
+	// an op that starts when another ends doesn't overlap it, one that
+	// finishes while another is running does
+	epoch := time.Unix(testTime, 0)
+	ops = []*Op{
+		{Ns: "db.coll", Type: Query, Timestamp: epoch.Add(10 * time.Millisecond), Millis: 10},
+		{Ns: "db.coll", Type: Query, Timestamp: epoch.Add(20 * time.Millisecond), Millis: 10},
+	}
+	concurrency = ScanTraceConcurrency(newSliceOpsReader(ops), len(ops))
+	ensure.DeepEqual(t, concurrency.MaxOverlap, 1)
+	ops = append(ops, &Op{Ns: "db.coll", Type: Query, Timestamp: epoch.Add(15 * time.Millisecond)})
+	concurrency = ScanTraceConcurrency(newSliceOpsReader(ops), len(ops))
+	ensure.DeepEqual(t, concurrency.MaxOverlap, 2)
+}
@@ -0,0 +1,236 @@
+package flashback
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ResultVerifier compares the results that the nodes return for the same op:
+// the documents of queries, the number of documents of counts, and the
+// document returned by findAndModify. It can also compare what updates and
+// removes did.
+type ResultVerifier struct {
+	// Compare the results of queries, counts and findAndModify
+	Reads bool
+	// Compare the number of documents that updates and removes matched,
+	// modified and removed, and the ids they upserted
+	Writes bool
+	// Compare the documents of queries regardless of their order
+	IgnoreOrder bool
+	// Fields left out of the comparison, i.e. "updatedAt" or "meta.version"
+	IgnoreFields []string
+}
+
+// Verifies tells whether the results of an op type are compared
+func (v *ResultVerifier) Verifies(opType OpType) bool {
+	switch opType {
+	case Query, Count, FindAndModify:
+		return v.Reads
+	case Update, Remove:
+		return v.Writes
+	}
+	return false
+}
+
+// Compare returns a description of how actual differs from expected, or an
+// empty string if they match. The results are what OpsExecutor.LastResult
+// returns. Numbers are compared by value, whatever their type.
+func (v *ResultVerifier) Compare(expected interface{}, actual interface{}) string {
+	switch expected := expected.(type) {
+	case *[]Document:
+		actualResult, ok := actual.(*[]Document)
+		if !ok || actualResult == nil {
+			return fmt.Sprintf("expected documents, got %s", docString(actual))
+		}
+		expectedDocs, actualDocs := v.normalize(*expected), v.normalize(*actualResult)
+		if len(expectedDocs) != len(actualDocs) {
+			return fmt.Sprintf("expected %d documents, got %d", len(expectedDocs), len(actualDocs))
+		}
+		for i := range expectedDocs {
+			if expectedDocs[i] != actualDocs[i] {
+				return fmt.Sprintf("document #%d differs: expected %s, got %s", i, expectedDocs[i], actualDocs[i])
+			}
+		}
+		return ""
+	case Document:
+		actualResult, ok := actual.(Document)
+		if !ok || actualResult == nil {
+			return fmt.Sprintf("expected a document, got %s", docString(actual))
+		}
+		expectedDoc, actualDoc := docString(v.strip(expected)), docString(v.strip(actualResult))
+		if expectedDoc != actualDoc {
+			return fmt.Sprintf("expected %s, got %s", expectedDoc, actualDoc)
+		}
+		return ""
+	case *WriteOutcome:
+		actualResult, ok := actual.(*WriteOutcome)
+		if !ok || actualResult == nil {
+			return fmt.Sprintf("expected a write outcome, got %s", docString(actual))
+		}
+		if expected.String() != actualResult.String() {
+			return fmt.Sprintf("expected %s, got %s", expected, actualResult)
+		}
+		return ""
+	}
+
+	if docString(expected) != docString(actual) {
+		return fmt.Sprintf("expected %s, got %s", docString(expected), docString(actual))
+	}
+	return ""
+}
+
+// normalize turns the documents into comparable strings, without the ignored
+// fields, and sorted if their order doesn't matter
+func (v *ResultVerifier) normalize(docs []Document) []string {
+	normalized := make([]string, len(docs))
+	for i, doc := range docs {
+		normalized[i] = docString(v.strip(doc))
+	}
+	if v.IgnoreOrder {
+		sort.Strings(normalized)
+	}
+	return normalized
+}
+
+// strip returns a copy of doc without the ignored fields
+func (v *ResultVerifier) strip(doc map[string]interface{}) map[string]interface{} {
+	for _, field := range v.IgnoreFields {
+		doc = withoutField(doc, strings.Split(field, "."))
+	}
+	return doc
+}
+
+func withoutField(doc map[string]interface{}, path []string) map[string]interface{} {
+	value, ok := doc[path[0]]
+	if !ok {
+		return doc
+	}
+	copied := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		copied[k] = v
+	}
+	if len(path) == 1 {
+		delete(copied, path[0])
+	} else if nested, ok := asMap(value); ok {
+		copied[path[0]] = withoutField(nested, path[1:])
+	}
+	return copied
+}
+
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	switch value := value.(type) {
+	case Document:
+		return value, true
+	case bson.M:
+		return value, true
+	case map[string]interface{}:
+		return value, true
+	}
+	return nil, false
+}
+
+// docString formats a value the same way whatever the order of its map keys
+// and the type of its numbers, so that values can be compared as strings
+func docString(value interface{}) string {
+	if m, ok := asMap(value); ok {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			fields[i] = k + ": " + docString(m[k])
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+
+	switch value := value.(type) {
+	case bson.D:
+		fields := make([]string, len(value))
+		for i, elem := range value {
+			fields[i] = elem.Name + ": " + docString(elem.Value)
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case string:
+		return strconv.Quote(value)
+	case []byte:
+		return fmt.Sprintf("%x", value)
+	case *WriteOutcome:
+		if value == nil {
+			return "null"
+		}
+		return value.String()
+	case *[]Document:
+		if value == nil {
+			return "null"
+		}
+		return docString(*value)
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	}
+
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Slice {
+		elems := make([]string, v.Len())
+		for i := range elems {
+			elems[i] = docString(v.Index(i).Interface())
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	}
+	return fmt.Sprint(value)
+}
+
+// mismatchLog writes a sample of the mismatches to a file, for inspection
+type mismatchLog struct {
+	mutex      sync.Mutex
+	file       *os.File
+	maxSamples int
+	written    int
+}
+
+func newMismatchLog(filename string, maxSamples int) (*mismatchLog, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &mismatchLog{file: file, maxSamples: maxSamples}, nil
+}
+
+func (l *mismatchLog) write(node string, reference string, op *Op, diff string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.written >= l.maxSamples {
+		return
+	}
+	l.written++
+
+	var args string
+	switch op.Type {
+	case Query, Remove:
+		args = docString(op.QueryDoc)
+	case Update:
+		args = docString(op.QueryDoc) + ", update: " + docString(op.UpdateDoc)
+	case Insert:
+		args = docString(op.InsertDoc)
+	default:
+		args = docString(op.CommandDoc)
+	}
+	fmt.Fprintf(l.file, "%s [%s] %s %s.%s differs from [%s]: %s\n  op: %s\n",
+		time.Now().Format("2006-01-02 15:04:05 -0700"), node, op.Type, op.Database, op.Collection,
+		reference, diff, args)
+	if l.written == l.maxSamples {
+		fmt.Fprintf(l.file, "Reached %d mismatches, the next ones are only counted\n", l.maxSamples)
+	}
+}
+
+func (l *mismatchLog) close() {
+	l.file.Close()
+}
@@ -0,0 +1,133 @@
+package flashback
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestResultVerifierVerifies(t *testing.T) {
+	t.Parallel()
+
+	verifier := &ResultVerifier{Reads: true}
+	ensure.True(t, verifier.Verifies(Query))
+	ensure.True(t, verifier.Verifies(Count))
+	ensure.True(t, verifier.Verifies(FindAndModify))
+	ensure.False(t, verifier.Verifies(Insert))
+	ensure.False(t, verifier.Verifies(Update))
+
+	verifier = &ResultVerifier{Writes: true}
+	ensure.False(t, verifier.Verifies(Query))
+	ensure.True(t, verifier.Verifies(Update))
+	ensure.True(t, verifier.Verifies(Remove))
+	ensure.False(t, verifier.Verifies(Insert))
+}
+
+func TestResultVerifierCompareDocuments(t *testing.T) {
+	t.Parallel()
+
+	docs := func(docs ...Document) *[]Document { return &docs }
+	a := Document{"_id": 1, "name": "a", "meta": bson.M{"version": 3, "tags": []interface{}{"x"}}}
+	b := Document{"_id": int64(2), "name": "b", "updatedAt": time.Unix(testTime, 0)}
+
+	verifier := &ResultVerifier{}
+	ensure.DeepEqual(t, verifier.Compare(docs(a, b), docs(a, b)), "")
+	// numbers are compared by value
+	ensure.DeepEqual(t, verifier.Compare(docs(a, b), docs(a, Document{"_id": 2.0, "name": "b",
+		"updatedAt": time.Unix(testTime, 0)})), "")
+	ensure.DeepEqual(t, verifier.Compare(docs(a, b), docs(a)), "expected 2 documents, got 1")
+	ensure.StringContains(t, verifier.Compare(docs(a, b), docs(b, a)), "document #0 differs")
+
+	verifier.IgnoreOrder = true
+	ensure.DeepEqual(t, verifier.Compare(docs(a, b), docs(b, a)), "")
+
+	changed := Document{"_id": 1, "name": "a", "meta": bson.M{"version": 4, "tags": []interface{}{"x"}}}
+	ensure.StringContains(t, verifier.Compare(docs(a), docs(changed)), "version: 3")
+	verifier.IgnoreFields = []string{"meta.version", "missing.field"}
+	ensure.DeepEqual(t, verifier.Compare(docs(a), docs(changed)), "")
+	// the results themselves are left untouched
+	ensure.DeepEqual(t, changed["meta"].(bson.M)["version"], 4)
+
+	ensure.StringContains(t, verifier.Compare(docs(a), 3), "expected documents")
+}
+
+func TestResultVerifierCompareOthers(t *testing.T) {
+	t.Parallel()
+
+	verifier := &ResultVerifier{IgnoreFields: []string{"updatedAt"}}
+	ensure.DeepEqual(t, verifier.Compare(12, 12), "")
+	ensure.DeepEqual(t, verifier.Compare(12, 11), "expected 12, got 11")
+
+	ensure.DeepEqual(t, verifier.Compare(Document{"n": 1, "updatedAt": 1}, Document{"n": 1, "updatedAt": 2}), "")
+	ensure.DeepEqual(t, verifier.Compare(Document{"n": 1}, Document{"n": 2}), "expected {n: 1}, got {n: 2}")
+	ensure.StringContains(t, verifier.Compare(Document{"n": 1}, nil), "expected a document")
+}
+
+func TestResultVerifierCompareWriteOutcomes(t *testing.T) {
+	t.Parallel()
+
+	verifier := &ResultVerifier{Writes: true}
+	updated := &WriteOutcome{Matched: 1, Modified: 1}
+	ensure.DeepEqual(t, verifier.Compare(updated, &WriteOutcome{Matched: 1, Modified: 1}), "")
+	ensure.DeepEqual(t, verifier.Compare(updated, &WriteOutcome{Matched: 1}),
+		"expected {matched: 1, modified: 1, removed: 0, upserted: none}, "+
+			"got {matched: 1, modified: 0, removed: 0, upserted: none}")
+	ensure.StringContains(t, verifier.Compare(&WriteOutcome{UpsertedId: 1}, &WriteOutcome{UpsertedId: int64(2)}),
+		"upserted: 2")
+	ensure.DeepEqual(t, verifier.Compare(&WriteOutcome{UpsertedId: 1}, &WriteOutcome{UpsertedId: int64(1)}), "")
+	ensure.DeepEqual(t, verifier.Compare(&WriteOutcome{Upserted: true}, &WriteOutcome{Upserted: true}), "")
+	ensure.DeepEqual(t, verifier.Compare(&WriteOutcome{Upserted: true}, &WriteOutcome{Matched: 1}),
+		"expected {matched: 0, modified: 0, removed: 0, upserted: generated _id}, "+
+			"got {matched: 1, modified: 0, removed: 0, upserted: none}")
+	ensure.DeepEqual(t, verifier.Compare(updated, (*WriteOutcome)(nil)), "expected a write outcome, got null")
+}
+
+func TestDocString(t *testing.T) {
+	t.Parallel()
+
+	ensure.DeepEqual(t, docString(Document{"b": "x", "a": []interface{}{1, bson.D{{"z", 1}, {"y", 2}}}}),
+		`{a: [1, {z: 1, y: 2}], b: "x"}`)
+	ensure.DeepEqual(t, docString(bson.M{"n": int32(5)}), docString(Document{"n": 5.0}))
+}
+
+func TestMismatchLog(t *testing.T) {
+	t.Parallel()
+
+	file, err := ioutil.TempFile("", "flashback_mismatches")
+	ensure.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	log, err := newMismatchLog(file.Name(), 2)
+	ensure.Nil(t, err)
+	op := &Op{Type: Query, Database: "db", Collection: "coll", QueryDoc: bson.D{{"_id", 1}}}
+	for i := 0; i < 5; i++ {
+		log.write("challenger", "default", op, "expected 1 documents, got 0")
+	}
+	log.close()
+	content, err := ioutil.ReadFile(file.Name())
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, strings.Count(string(content), "[challenger] query db.coll differs from [default]"), 2)
+	ensure.StringContains(t, string(content), "op: {_id: 1}")
+	ensure.StringContains(t, string(content), "Reached 2 mismatches")
+
+	// writes are logged with their query and update
+	log, err = newMismatchLog(file.Name(), 2)
+	ensure.Nil(t, err)
+	update := &Op{Type: Update, Database: "db", Collection: "coll", QueryDoc: bson.D{{"_id", 1}},
+		UpdateDoc: bson.D{{"$set", bson.D{{"a", 2}}}}}
+	log.write("challenger", "default", update, "matched 1 documents, not 0")
+	remove := &Op{Type: Remove, Database: "db", Collection: "coll", QueryDoc: bson.D{{"_id", 2}}}
+	log.write("challenger", "default", remove, "removed 1 documents, not 0")
+	log.close()
+
+	content, err = ioutil.ReadFile(file.Name())
+	ensure.Nil(t, err)
+	ensure.StringContains(t, string(content), "op: {_id: 1}, update: {$set: {a: 2}}")
+	ensure.StringContains(t, string(content), "op: {_id: 2}")
+}
@@ -0,0 +1,73 @@
+package flashback
+
+import (
+	"errors"
+	"sync"
+)
+
+// workerPool keeps track of the running workers, and lets the number of
+// workers change while ops are replayed.
+type workerPool struct {
+	mutex sync.Mutex
+	wg    sync.WaitGroup
+	// one per running worker, closed to let the worker go
+	quits  []chan struct{}
+	nextId int
+	// whether the workers share the ops, so that workers can come and go
+	resizable bool
+	work      func(id int, quit chan struct{})
+}
+
+func newWorkerPool(workers int, resizable bool, work func(id int, quit chan struct{})) *workerPool {
+	p := &workerPool{resizable: resizable, work: work}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.grow(workers)
+	return p
+}
+
+func (p *workerPool) grow(workers int) {
+	for i := 0; i < workers; i++ {
+		quit := make(chan struct{})
+		p.quits = append(p.quits, quit)
+		p.wg.Add(1)
+		go func(id int) {
+			defer p.wg.Done()
+			p.work(id, quit)
+		}(p.nextId)
+		p.nextId++
+	}
+}
+
+// resize starts or lets go workers until there are the given number of them.
+// The workers that are let go finish their current op first.
+func (p *workerPool) resize(workers int) error {
+	if workers <= 0 {
+		return errors.New("the number of workers must be a positive number")
+	}
+	if !p.resizable {
+		return errors.New("the number of workers can't change when each worker has its own ops")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if workers > len(p.quits) {
+		p.grow(workers - len(p.quits))
+	}
+	for len(p.quits) > workers {
+		close(p.quits[len(p.quits)-1])
+		p.quits = p.quits[:len(p.quits)-1]
+	}
+	return nil
+}
+
+func (p *workerPool) size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.quits)
+}
+
+// wait blocks until all the workers are done
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}